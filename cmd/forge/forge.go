@@ -18,6 +18,7 @@ const helpMe = `Usage of forge:
 Where "cmd" is one of:
 
   deploy
+  status
   run
   version
   db
@@ -53,5 +54,8 @@ func main() {
 
 func prettyExit(message interface{}) {
 	fmt.Fprintln(os.Stderr, message)
+	if coder, ok := message.(forge.ExitCoder); ok {
+		os.Exit(coder.ExitCode())
+	}
 	os.Exit(1)
 }
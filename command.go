@@ -5,6 +5,12 @@ import (
 	"os"
 )
 
+// ExitCoder is implemented by errors that should make forge exit with a
+// specific status code instead of the default of 1.
+type ExitCoder interface {
+	ExitCode() int
+}
+
 type Cmd struct {
 	Name    string
 	Conf    *Config
@@ -12,11 +18,31 @@ type Cmd struct {
 	Flags   *flag.FlagSet
 
 	SubRunner func() error
+
+	// Vars holds every variable for the environment once the Forgefile has
+	// been read: the vars blocks, overridden by --var.
+	Vars Vars
+
+	// SubCmds are commands nested under this one, such as `forge deploy
+	// history`. They are registered with RegisterSub.
+	SubCmds map[string]*Cmd
 }
 
 func (cmd *Cmd) Run() error {
-	cmd.Flags.Parse(os.Args[2:])
-	ParseConfig(cmd.Conf.Env)
+	return cmd.run(os.Args[2:])
+}
+
+// run hands args off to a nested command if the first argument names one,
+// otherwise it parses args and runs this command.
+func (cmd *Cmd) run(args []string) error {
+	if len(args) > 0 {
+		if sub, ok := cmd.SubCmds[args[0]]; ok {
+			return sub.run(args[1:])
+		}
+	}
+
+	cmd.Flags.Parse(args)
+	cmd.Vars = ParseConfig(cmd.Conf.Env, cmd.Conf.Vars)
 
 	return cmd.SubRunner()
 }
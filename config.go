@@ -2,4 +2,7 @@ package forge
 
 type Config struct {
 	Env string
+
+	// Vars holds the variables set with --var.
+	Vars Vars
 }
@@ -20,12 +20,27 @@ var (
 // Register registers subcommands and their configurations in a central
 // location.
 func Register(cmd *Cmd) {
-	cmd.Conf = &Config{}
-	cmd.Flags.StringVar(&cmd.Conf.Env, "env", "development", "Set the environment for forge to run in.")
-
+	addConfigFlags(cmd)
 	Registry[cmd.Name] = cmd
 }
 
+// RegisterSub registers sub as a command nested under parent, so that it can
+// be run as `forge parent sub [options]`. The Forgefile is still read into
+// the parent's SubConf.
+func RegisterSub(parent *Cmd, sub *Cmd) {
+	addConfigFlags(sub)
+	if parent.SubCmds == nil {
+		parent.SubCmds = make(map[string]*Cmd)
+	}
+	parent.SubCmds[sub.Name] = sub
+}
+
+func addConfigFlags(cmd *Cmd) {
+	cmd.Conf = &Config{Vars: make(Vars)}
+	cmd.Flags.StringVar(&cmd.Conf.Env, "env", "development", "Set the environment for forge to run in.")
+	cmd.Flags.Var(cmd.Conf.Vars, "var", "Set a variable as key=value, can be repeated.")
+}
+
 func IsRegisteredCmd(cmdName string) bool {
 	_, ok := Registry[cmdName]
 	return ok
@@ -39,24 +54,64 @@ func CmdForName(name string) (*Cmd, error) {
 	return nil, ErrNoCmd
 }
 
-func ParseConfig(env string) {
+// ParseConfig reads the Forgefile for env into the registered commands'
+// configurations, and returns the variables for env.
+//
+// The Forgefile is read twice. The first pass only collects the vars blocks,
+// so that the second pass can interpolate them with the `var` template
+// function. Variables from vars take precedence over the vars blocks.
+func ParseConfig(env string, vars Vars) Vars {
+	return parseForgefile(env, vars, NewParser(env))
+}
+
+// ParseSection reads only the named section of the Forgefile for env, such
+// as "deploy", into conf, and returns the variables for env. Unlike
+// ParseConfig, it leaves the registered commands' configurations alone, so
+// that another environment's settings can be read next to the current one's.
+func ParseSection(env string, vars Vars, section string, conf interface{}) Vars {
+	return parseForgefile(env, vars, newSectionParser(env, section, conf))
+}
+
+// parseForgefile reads the Forgefile for env into unformatter, with the vars
+// blocks merged with vars, and returns the merged variables.
+func parseForgefile(env string, vars Vars, unformatter *Unformatter) Vars {
+	vu := varsUnformatter{}
+	if err := yaml.Unmarshal(renderForgefile(vars), &vu); err != nil {
+		panic(err)
+	}
+	merged := vu.envVars(env).merge(vars)
+
+	if err := yaml.Unmarshal(renderForgefile(merged), unformatter); err != nil {
+		panic(err)
+	}
+	return merged
+}
+
+// renderForgefile executes the Forgefile template with vars available to the
+// `var` function. Undefined variables are empty, so that they can be given a
+// default with `def`.
+func renderForgefile(vars Vars) []byte {
 	buffer := &bytes.Buffer{}
 	tmpl := template.Must(
 		template.New(
 			"forgefile",
-		).Funcs(template.FuncMap{
-			"env": os.Getenv,
-			"def": defaultValue,
-		}).ParseFiles(forgefile),
+		).Funcs(TemplateFuncs(vars)).ParseFiles(forgefile),
 	).Lookup("Forgefile")
 
 	if err := tmpl.Execute(buffer, struct{}{}); err != nil {
 		panic(err)
 	}
+	return buffer.Bytes()
+}
 
-	unformatter := NewParser(env)
-	if err := yaml.Unmarshal(buffer.Bytes(), unformatter); err != nil {
-		panic(err)
+// TemplateFuncs returns the functions that the Forgefile template can use,
+// with vars available to `var`. Anything else that renders templates for
+// forge should use them too, so that the templates work the same way.
+func TemplateFuncs(vars Vars) template.FuncMap {
+	return template.FuncMap{
+		"env": os.Getenv,
+		"def": defaultValue,
+		"var": func(name string) string { return vars[name] },
 	}
 }
 
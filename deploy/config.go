@@ -2,21 +2,172 @@ package deploy
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/ki4jnq/forge/deploy/engine"
+	"github.com/ki4jnq/forge/deploy/history"
+	"github.com/ki4jnq/forge/deploy/lock"
+	"github.com/ki4jnq/forge/deploy/notify"
 	"github.com/ki4jnq/forge/deploy/shippers"
 	"github.com/ki4jnq/forge/deploy/shippers/k8"
 )
 
-var ErrNotAShipper = errors.New("Undefined shipper requested in Forgefile")
+var (
+	ErrNotAShipper = errors.New("Undefined shipper requested in Forgefile")
+)
+
+// defaultBackoff is how long to wait before retrying a target when the
+// Forgefile doesn't say.
+const defaultBackoff = 5 * time.Second
+
+// reservedKeys are the keys in the deploy section that hold settings for the
+// whole environment rather than naming a deploy target.
+var reservedKeys = map[string]bool{
+	"history": true,
+	"hooks":   true,
+	"lock":    true,
+	"notify":  true,
+	"version": true,
+}
+
+// Config is the deploy section of the Forgefile. Every key names a deploy
+// target, except for the reserved keys which configure the deploy itself.
+type Config struct {
+	Targets targetBlocks `yaml:"-"`
+
+	History historyBlock
+	Hooks   hooksBlock
+	Lock    lockBlock
+	Notify  []notifyBlock
+	Version versionBlock
+}
+
+// UnmarshalYAML reads the reserved keys into the Config's settings and every
+// other key into Targets. It merges into the existing Config so that the
+// "all" environment can be combined with the selected one.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var blocks map[string]*blockNode
+	if err := unmarshal(&blocks); err != nil {
+		return err
+	}
+
+	// Catch targets from before a key was reserved, rather than failing to
+	// read them as settings or silently dropping them.
+	for name, node := range blocks {
+		if reservedKeys[name] && node.err == nil && node.block.ShipperName != "" {
+			return fmt.Errorf(
+				"Invalid deploy target \"%v\": the name is reserved for the deploy's %v settings, rename the target",
+				name,
+				name,
+			)
+		}
+	}
+
+	type settings Config
+	if err := unmarshal((*settings)(c)); err != nil {
+		return err
+	}
 
-type Config map[string]shipperBlock
+	if c.Targets == nil {
+		c.Targets = make(targetBlocks, len(blocks))
+	}
+	for name, node := range blocks {
+		if reservedKeys[name] {
+			continue
+		}
+		if node.err != nil {
+			return fmt.Errorf("Invalid deploy target \"%v\": %v", name, node.err)
+		}
+		c.Targets[name] = node.block
+	}
+	return nil
+}
+
+// blockNode defers reporting errors from parsing a shipperBlock until it is
+// known whether the key was a target at all.
+type blockNode struct {
+	block shipperBlock
+	err   error
+}
+
+func (bn *blockNode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	bn.err = unmarshal(&bn.block)
+	return nil
+}
+
+type targetBlocks map[string]shipperBlock
 
 // shipperBlock represents a configuration block from the Forgefile for an
 // individual shipper object.
 type shipperBlock struct {
 	ShipperName string `yaml:"shipper"`
 	Opts        map[string]interface{}
+
+	// DependsOn lists the targets that must ship before this one starts.
+	DependsOn []string `yaml:"depends_on"`
+
+	// Timeout and Backoff are durations such as "90s" or "10m".
+	Timeout string
+	Retries int
+	Backoff string
+
+	Hooks hooksBlock
+
+	// Approve makes the deploy ask for confirmation before this target ships.
+	Approve bool
+}
+
+// hooksBlock lists the shell commands to run around a deploy, or around a
+// single target.
+type hooksBlock struct {
+	Before     []string
+	After      []string
+	OnFailure  []string `yaml:"on_failure"`
+	OnRollback []string `yaml:"on_rollback"`
+}
+
+// toTarget builds an engine Target, with its Shipper, from the configuration.
+func (sb *shipperBlock) toTarget() (*engine.Target, error) {
+	timeout, err := parseDuration("timeout", sb.Timeout, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	backoff, err := parseDuration("backoff", sb.Backoff, defaultBackoff)
+	if err != nil {
+		return nil, err
+	}
+
+	if sb.Retries < 0 {
+		return nil, fmt.Errorf("Invalid retries %d, it can't be negative", sb.Retries)
+	}
+
+	return &engine.Target{
+		Shipper:   sb.toShipper(),
+		DependsOn: sb.DependsOn,
+		Timeout:   timeout,
+		Retries:   sb.Retries,
+		Backoff:   backoff,
+		Hooks:     engine.Hooks(sb.Hooks),
+		Approve:   sb.Approve,
+	}, nil
+}
+
+// parseDuration parses the value of the duration option named key, returning
+// def when the option is not set.
+func parseDuration(key, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v %q: %v", key, value, err)
+	} else if duration < 0 {
+		return 0, fmt.Errorf("Invalid %v %q, it can't be negative", key, value)
+	}
+	return duration, nil
 }
 
 // toShipper builds a Shipper object from the configuration.
@@ -32,6 +183,14 @@ func (sb *shipperBlock) toShipper() engine.Shipper {
 		return k8.NewDeploymentShipper(sb.Opts)
 	case "k8-cron":
 		return k8.NewCronShipper(sb.Opts)
+	case "k8-statefulset":
+		return k8.NewStatefulSetShipper(sb.Opts)
+	case "k8-daemonset":
+		return k8.NewDaemonSetShipper(sb.Opts)
+	case "k8-job":
+		return k8.NewJobShipper(sb.Opts)
+	case "k8-apply":
+		return k8.NewApplyShipper(sb.Opts)
 	case "shell":
 		return &shippers.ShellShipper{Opts: sb.Opts}
 	case "app-engine":
@@ -40,3 +199,84 @@ func (sb *shipperBlock) toShipper() engine.Shipper {
 		panic(ErrNotAShipper)
 	}
 }
+
+// historyBlock configures where deploys are recorded.
+type historyBlock struct {
+	// Backend selects the history.Store, "file" (the default) or "none".
+	Backend string
+	File    string
+}
+
+// store builds the history.Store described by the configuration.
+func (hb *historyBlock) store() (history.Store, error) {
+	switch hb.Backend {
+	case "", "file":
+		path := hb.File
+		if path == "" {
+			path = history.DefaultFile
+		}
+		return &history.FileStore{Path: path}, nil
+	case "none":
+		return history.NullStore{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown deploy history backend %q", hb.Backend)
+	}
+}
+
+// lockBlock configures how an environment is locked during a deploy.
+type lockBlock struct {
+	// Backend selects the lock.Locker, "file" (the default), "k8",
+	// "k8-lease" or "none".
+	Backend string
+	Dir     string
+
+	// Opts holds the connection options for the "k8" and "k8-lease"
+	// backends. They are the same as the options for the k8 shippers.
+	Opts map[string]interface{}
+}
+
+// locker builds the lock.Locker described by the configuration.
+func (lb *lockBlock) locker() (lock.Locker, error) {
+	switch lb.Backend {
+	case "", "file":
+		dir := lb.Dir
+		if dir == "" {
+			dir = lock.DefaultDir
+		}
+		return &lock.FileLocker{Dir: dir}, nil
+	case "k8":
+		return k8.NewLocker(lb.Opts), nil
+	case "k8-lease":
+		return k8.NewLeaseLocker(lb.Opts), nil
+	case "none":
+		return lock.NullLocker{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown deploy lock backend %q", lb.Backend)
+	}
+}
+
+// notifyBlock configures a webhook that is told about the deploy.
+type notifyBlock struct {
+	URL      string `yaml:"url"`
+	Preset   string
+	Template string
+	Events   []string
+}
+
+// notifier returns a Reporter that sends the configured notifications, or
+// nil when there aren't any.
+func (c *Config) notifier(env, version string) (engine.Reporter, error) {
+	if len(c.Notify) == 0 {
+		return nil, nil
+	}
+
+	sinks := make([]*notify.Sink, len(c.Notify))
+	for i, nb := range c.Notify {
+		sink, err := notify.NewSink(nb.URL, nb.Preset, nb.Template, nb.Events)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid notify block %d: %v", i+1, err)
+		}
+		sinks[i] = sink
+	}
+	return notify.New(env, version, sinks), nil
+}
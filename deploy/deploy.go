@@ -2,45 +2,232 @@ package deploy
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
 	"github.com/ki4jnq/forge"
 	"github.com/ki4jnq/forge/deploy/engine"
+	"github.com/ki4jnq/forge/deploy/lock"
+	"github.com/ki4jnq/forge/deploy/shippers"
 )
 
 var (
-	conf  = Config{}
+	cmd   *forge.Cmd
+	conf  = &Config{}
 	flags = flag.NewFlagSet("deploy", flag.ExitOnError)
 	opts  = engine.Options{}
+
+	planOnly bool
+	only     targetList
+	skip     targetList
+	output   string
+
+	forceUnlock bool
+	autoApprove bool
+	allowDirty  bool
 )
 
 func init() {
-	flags.StringVar(
-		&opts.AppEngine.ImageTag,
-		"ae-image-tag",
-		"",
-		"The AppEngine Docker image tag to deploy",
-	)
 	flags.StringVar(
 		&opts.Version,
 		"version",
 		"",
-		"The version number to deploy.",
+		"The version number to deploy, instead of the one found by the Forgefile's version strategy.",
+	)
+	addRunFlags(flags)
+
+	flags.BoolVar(
+		&allowDirty,
+		"allow-dirty",
+		false,
+		"Deploy even if the working tree has uncommitted changes.",
+	)
+	flags.BoolVar(
+		&forceUnlock,
+		"force-unlock",
+		false,
+		"Release the deploy lock for the environment, then exit without deploying.",
 	)
 
-	forge.Register(&forge.Cmd{
+	cmd = &forge.Cmd{
 		Name:      "deploy",
 		Flags:     flags,
 		SubConf:   conf,
 		SubRunner: run,
-	})
+	}
+	forge.Register(cmd)
+
+	// The Forgefile is rendered with the variables, so the tag has to be set
+	// among them while the flags are parsed.
+	flags.Var(
+		varFlag{vars: cmd.Conf.Vars, name: shippers.AEImageTagVar},
+		"ae-image-tag",
+		"The AppEngine Docker image `tag` to deploy, short for --var ae_image_tag=<tag>",
+	)
+
+	registerHistory()
+	registerPromote()
+	registerStatus()
+}
+
+// varFlag is a flag.Value that sets the variable name in vars, for flags that
+// are short for --var name=<value>.
+type varFlag struct {
+	vars forge.Vars
+	name string
+}
+
+func (vf varFlag) String() string {
+	return vf.vars[vf.name]
+}
+
+func (vf varFlag) Set(value string) error {
+	vf.vars[vf.name] = value
+	return nil
+}
+
+// addRunFlags adds the flags that control how a deploy runs, which are shared
+// by every command that deploys.
+func addRunFlags(fs *flag.FlagSet) {
+	fs.BoolVar(
+		&planOnly,
+		"plan",
+		false,
+		"Print what each target would do without deploying anything.",
+	)
+	fs.Var(
+		&only,
+		"only",
+		"Comma separated list of targets to deploy, all others are ignored.",
+	)
+	fs.Var(
+		&skip,
+		"skip",
+		"Comma separated list of targets that should not be deployed.",
+	)
+	fs.StringVar(
+		&output,
+		"output",
+		"text",
+		"The format of deploy progress, either \"text\" or \"json\" (one event per line).",
+	)
+	fs.BoolVar(
+		&autoApprove,
+		"auto-approve",
+		false,
+		"Approve every target that needs approval without asking.",
+	)
 }
 
 func run() error {
-	shippers := make(map[string]engine.Shipper, len(conf))
-	for target, block := range conf {
-		shippers[target] = block.toShipper()
+	env := cmd.Conf.Env
+	if forceUnlock {
+		locker, err := conf.Lock.locker()
+		if err != nil {
+			return err
+		}
+		if err := locker.Unlock(env); err != nil {
+			return err
+		}
+		fmt.Printf("Released the deploy lock for the \"%v\" environment\n", env)
+		return nil
+	}
+
+	// A promoted version was built before, so only `forge deploy` cares
+	// about the working tree.
+	if !planOnly && !allowDirty {
+		if err := checkClean(); err != nil {
+			return err
+		}
+	}
+	return deployEnv(env, cmd.Vars)
+}
+
+// deployEnv deploys the selected targets from conf to env with opts and
+// vars.
+func deployEnv(env string, vars forge.Vars) error {
+	opts.Env = env
+	opts.Vars = vars
+	locker, err := conf.Lock.locker()
+	if err != nil {
+		return err
+	}
+
+	selected, err := conf.Targets.selectTargets(env, only, skip)
+	if err != nil {
+		return err
+	}
+
+	targets := make(engine.Targets, len(selected))
+	for name, block := range selected {
+		if targets[name], err = block.toTarget(); err != nil {
+			return fmt.Errorf("Deploy target \"%v\": %v", name, err)
+		}
+	}
+
+	// The version is only required if one of the targets ships it. Other
+	// deploys still pass it to hooks and record it when it can be found.
+	version, err := conf.Version.resolve(opts.Version)
+	if err != nil && needsVersion(targets) {
+		return err
+	}
+	opts.Version = version
+
+	eng := engine.NewEngine(targets)
+	eng.Hooks = engine.Hooks(conf.Hooks)
+	if eng.Reporter, err = newReporter(output); err != nil {
+		return err
+	}
+
+	if planOnly {
+		return eng.Plan(opts)
 	}
 
-	eng := engine.NewEngine(shippers)
-	return eng.Run(opts)
+	eng.Approver = newApprover()
+
+	notifier, err := conf.notifier(env, opts.Version)
+	if err != nil {
+		return err
+	}
+	if notifier != nil {
+		eng.Reporter = engine.MultiReporter{eng.Reporter, notifier}
+	}
+
+	if err := locker.Lock(env, lock.NewHolder(opts.Version)); err != nil {
+		return err
+	}
+	defer func() {
+		if err := locker.Unlock(env); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: failed to release the deploy lock: %v\n", err)
+		}
+	}()
+
+	return runAndRecord(eng, env, selected)
+}
+
+// newApprover asks for approval on the terminal, unless --auto-approve was
+// passed. It returns nil when there is no terminal, so that targets that need
+// approval fail instead of waiting forever.
+func newApprover() engine.Approver {
+	if autoApprove {
+		return engine.AutoApprover{}
+	}
+
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return engine.NewPromptApprover(os.Stdin, os.Stderr)
+}
+
+// newReporter builds the engine.Reporter for the --output format.
+func newReporter(format string) (engine.Reporter, error) {
+	switch format {
+	case "text":
+		return engine.NewConsoleReporter(os.Stdout), nil
+	case "json":
+		return engine.NewJSONReporter(os.Stdout, os.Stderr), nil
+	default:
+		return nil, fmt.Errorf("Unknown output format %q, expected \"text\" or \"json\"", format)
+	}
 }
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrApprovalDeclined = errors.New("Approval was declined")
+	ErrApprovalRequired = errors.New(
+		"This target needs approval, but there is no terminal to ask on, pass --auto-approve to approve it",
+	)
+)
+
+// An Approver decides whether a target that needs approval may ship. plan is
+// what the target's shipper says it is about to do.
+type Approver interface {
+	Approve(ctx context.Context, target, plan string) (bool, error)
+}
+
+// AutoApprover approves every target without asking, for CI.
+type AutoApprover struct{}
+
+func (AutoApprover) Approve(ctx context.Context, target, plan string) (bool, error) {
+	return true, nil
+}
+
+// PromptApprover asks for approval on a terminal. Targets that need approval
+// at the same time are asked about one after the other.
+type PromptApprover struct {
+	mu  sync.Mutex
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func NewPromptApprover(in io.Reader, out io.Writer) *PromptApprover {
+	return &PromptApprover{in: bufio.NewReader(in), out: out}
+}
+
+// Approve shows the plan and waits for an answer. Anything but "y" or "yes"
+// declines, as does reaching the end of the input.
+func (pa *PromptApprover) Approve(ctx context.Context, target, plan string) (bool, error) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+
+	fmt.Fprintf(pa.out, "Target %q needs approval before it ships:\n", target)
+	fmt.Fprintf(pa.out, "%v\n", indent(strings.TrimRight(plan, "\n")))
+	fmt.Fprintf(pa.out, "Ship %q? [y/N]: ", target)
+
+	// Reading can't be interrupted, so wait for it in the background and
+	// give up if the deploy is canceled in the meantime.
+	answer := make(chan string, 1)
+	go func() {
+		line, err := pa.in.ReadString('\n')
+		if err != nil {
+			fmt.Fprintln(pa.out)
+		}
+		answer <- line
+	}()
+
+	select {
+	case <-ctx.Done():
+		fmt.Fprintln(pa.out)
+		return false, ctx.Err()
+	case line := <-answer:
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			return true, nil
+		}
+		return false, nil
+	}
+}
+
+// approve asks the Engine's Approver whether the target may ship, showing it
+// the target's plan. It returns ErrApprovalDeclined if the answer is no.
+func (eng *Engine) approve(ctx context.Context, name string, target *Target) error {
+	if eng.Approver == nil {
+		return ErrApprovalRequired
+	}
+
+	plan, err := planFor(ctx, target)
+	if err != nil {
+		plan = fmt.Sprintf("The plan could not be made: %v", err)
+	}
+
+	eng.report(Event{Type: EventProgress, Target: name, Message: "Waiting for approval"})
+	ok, err := eng.Approver.Approve(ctx, name, plan)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrApprovalDeclined
+	}
+
+	eng.report(Event{Type: EventProgress, Target: name, Message: "Approved"})
+	return nil
+}
+
+// declined reports whether a target's approval was declined.
+func declined(errs []*TargetErr) bool {
+	for _, err := range errs {
+		if err.Err == ErrApprovalDeclined {
+			return true
+		}
+	}
+	return false
+}
+
+// errCh returns a closed channel holding err, for targets that fail before
+// they start.
+func errCh(err error) chan error {
+	ch := make(chan error, 1)
+	ch <- err
+	close(ch)
+	return ch
+}
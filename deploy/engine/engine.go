@@ -4,96 +4,306 @@ import (
 	"context"
 	"fmt"
 	"os"
-	"strings"
 	"sync"
+	"time"
 )
 
 // Engine manages the details of orchestrating deployments across a range of
 // deployment targets.
 type Engine struct {
-	Shippers map[string]Shipper
+	Targets  Targets
+	Reporter Reporter
+
+	// Hooks run around the deploy as a whole.
+	Hooks Hooks
+
+	// Approver is asked about every target that needs approval. Those
+	// targets fail if it is nil.
+	Approver Approver
+
+	graph    *graph
+	statuses map[string]*targetStatus
 }
 
-// NewEngine creates a new Engine that manages the provided shippers.
-func NewEngine(shippers map[string]Shipper) *Engine {
+// NewEngine creates a new Engine that manages the provided targets. Events
+// are written to stdout until a different Reporter is set.
+func NewEngine(targets Targets) *Engine {
 	return &Engine{
-		Shippers: shippers,
+		Targets:  targets,
+		Reporter: NewConsoleReporter(os.Stdout),
 	}
 }
 
-// Run performs a deployment based on the configured shippers and the provided
-// options. A failure in a single shipper will result in a rollback being
-// issued across all shippers as well.
+// Run performs a deployment based on the configured targets and the provided
+// options. Targets are shipped in dependency order, with independent targets
+// running in parallel. A failure in a single shipper will result in a
+// rollback being issued for every target that shipped, or at least started
+// changing things, before the failure.
+//
+// The first SIGINT or SIGTERM received during Run cancels the deploy and
+// rolls back like any other failure. A second one aborts the rollback and
+// makes Run return straight away.
 func (eng *Engine) Run(opts Options) error {
-	ctx := ContextForOptions(opts)
+	ctx := WithReporter(ContextForOptions(opts), eng.Reporter)
+	deployCtx, interrupt := context.WithCancel(ctx)
+	rollbackCtx, abort := context.WithCancel(ctx)
+	defer interrupt()
+	defer abort()
+
+	stop := eng.handleSignals(interrupt, abort)
+	defer stop()
+
+	// Refuse to ship anything if the targets can't be ordered.
+	g, err := newGraph(eng.Targets)
+	if err != nil {
+		return err
+	}
+	eng.graph = g
+	eng.statuses = newStatuses(eng.Targets)
+
+	eng.report(Event{
+		Type:    EventDeployStarted,
+		Message: fmt.Sprintf("Deploying %d target(s), version %q", len(eng.Targets), opts.Version),
+	})
+
+	// Nothing has changed yet, so a failed before hook doesn't need a
+	// rollback.
+	if err := eng.runHooks(deployCtx, HookBefore, eng.Hooks.Before, "", outcomePending); err != nil {
+		eng.report(Event{Type: EventDeployFinished, Error: err.Error()})
+		return err
+	}
 
 	// Run the deploy and return if everything works.
-	finalErr := eng.runDeploy(ctx)
-	if finalErr == nil {
-		return nil
+	deployErrs := eng.runDeploy(deployCtx, rollbackCtx)
+	interrupted := deployCtx.Err() != nil
+	if len(deployErrs) == 0 && !interrupted {
+		err := eng.runHooks(deployCtx, HookAfter, eng.Hooks.After, "", outcomeSucceeded)
+		if err == nil {
+			eng.report(Event{Type: EventDeployFinished, Summary: eng.Summary()})
+			return nil
+		}
+		deployErrs = append(deployErrs, &TargetErr{Err: err})
 	}
+	eng.runReportOnlyHooks(rollbackCtx, HookOnFailure, eng.Hooks.OnFailure, "", outcomeFailed)
 
-	fmt.Println(strings.Repeat("*", 80))
-	fmt.Println("An error was encountered while deploying the application")
-	fmt.Printf("The error message was: %v\n", finalErr)
-	fmt.Println(strings.Repeat("*", 80))
+	message := fmt.Sprintf("%d target(s) failed, rolling back", countTargets(deployErrs))
+	if interrupted {
+		message = "The deploy was interrupted, rolling back"
+	} else if declined(deployErrs) {
+		message = "Approval was declined, rolling back"
+	}
+	eng.report(Event{Type: EventRollbackStarted, Message: message})
+	rollbackErrs := eng.runRollback(rollbackCtx)
 
-	if err := eng.runRollback(ctx); err != nil {
-		return nil
+	outcome := outcomeRolledBack
+	finished := Event{Type: EventRollbackFinished}
+	if len(rollbackErrs) > 0 {
+		outcome = outcomeRollbackFailed
+		finished.Error = fmt.Sprintf("%d target(s) failed to roll back", countTargets(rollbackErrs))
 	}
+	eng.report(finished)
+	eng.runReportOnlyHooks(rollbackCtx, HookOnRollback, eng.Hooks.OnRollback, "", outcome)
 
+	finalErr := &DeployErr{
+		Deploy:      deployErrs,
+		Rollback:    rollbackErrs,
+		Interrupted: interrupted,
+	}
+	eng.report(Event{
+		Type:    EventDeployFinished,
+		Error:   finalErr.Error(),
+		Summary: eng.Summary(),
+	})
 	return finalErr
 }
 
 // runDeploy runs every shipper's ShipIt method with a shared context and
-// returns the error
-func (eng *Engine) runDeploy(baseCtx context.Context) (err error) {
+// returns their errors. A target is only shipped once all of its
+// dependencies have shipped successfully. The targets' on_failure hooks run
+// with failureCtx, which outlives a canceled deploy.
+func (eng *Engine) runDeploy(baseCtx, failureCtx context.Context) (errs []*TargetErr) {
 	ctx, cancel := context.WithCancel(baseCtx)
 	defer cancel()
 
-	deployCh := eng.fanIn(func(shipper Shipper) chan error {
-		return shipper.ShipIt(ctx)
-	})
+	deployCh := eng.walk(
+		eng.graph.dependencies,
+		true,
+		func(target string, shipper Shipper) chan error {
+			// Don't start anything new once the deploy has been canceled.
+			if ctx.Err() != nil {
+				eng.report(Event{
+					Type:    EventTargetSkipped,
+					Target:  target,
+					Message: "the deploy was canceled",
+				})
+				return closedErrCh()
+			}
+
+			status := eng.statuses[target]
+			status.setState(StateInProgress)
+			eng.report(Event{Type: EventTargetStarted, Target: target})
+
+			// Declining a target stops the deploy, so that whatever already
+			// shipped is rolled back.
+			if eng.Targets[target].Approve {
+				if err := eng.approve(ctx, target, eng.Targets[target]); err != nil {
+					if err == ErrApprovalDeclined {
+						cancel()
+					}
+					return errCh(err)
+				}
+			}
+			return eng.shipWithHooks(status.InContext(ctx), failureCtx, target, eng.Targets[target])
+		},
+		func(target string, ok bool) {
+			status := eng.statuses[target]
+			if status.getState() != StateInProgress {
+				return
+			}
+
+			if ok {
+				status.setState(StateShipped)
+			} else {
+				status.setState(StateFailed)
+			}
+			eng.report(Event{
+				Type:    EventTargetCompleted,
+				Target:  target,
+				Message: status.getState().String(),
+			})
+		},
+	)
 
-	for err = range deployCh {
-		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	for err := range deployCh {
+		errs = append(errs, err)
 	}
 
 	return
 }
 
-func (eng *Engine) runRollback(baseCtx context.Context) (err error) {
-	ctx, cancel := context.WithCancel(baseCtx)
-	defer cancel()
+// runRollback runs Rollback for every target that needs it, in reverse
+// dependency order so a target is only rolled back after everything that
+// depends on it. It returns every error the rollbacks reported.
+//
+// If ctx is canceled, runRollback returns without waiting for the
+// rollbacks that are still running, and every target that hasn't finished
+// rolling back gets an ErrRollbackAborted.
+func (eng *Engine) runRollback(ctx context.Context) (errs []*TargetErr) {
+	rollbackCh := eng.walk(
+		eng.graph.dependents,
+		false,
+		func(target string, shipper Shipper) chan error {
+			status := eng.statuses[target]
+			if !status.needsRollback() || ctx.Err() != nil {
+				return closedErrCh()
+			}
 
-	rollbackCh := eng.fanIn(func(shipper Shipper) chan error {
-		return shipper.Rollback(ctx)
-	})
+			status.setRollback(RollbackInProgress)
+			eng.report(Event{Type: EventRollbackStarted, Target: target})
+			return eng.rollbackWithHooks(status.InContext(ctx), target, eng.Targets[target])
+		},
+		func(target string, ok bool) {
+			status := eng.statuses[target]
+			if status.getRollback() != RollbackInProgress {
+				return
+			}
 
-	for err = range rollbackCh {
-		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			if ok {
+				status.setRollback(RollbackDone)
+			} else {
+				status.setRollback(RollbackFailed)
+			}
+			eng.report(Event{Type: EventRollbackFinished, Target: target})
+		},
+	)
+
+	for {
+		select {
+		case err, ok := <-rollbackCh:
+			if !ok {
+				return
+			}
+			eng.statuses[err.Target].addErr(err.Err)
+			errs = append(errs, err)
+		case <-ctx.Done():
+			// Keep draining the errors of the rollbacks that are still
+			// running, so that walk's goroutines can finish.
+			go func() {
+				for range rollbackCh {
+				}
+			}()
+			return append(errs, eng.abortRollbacks()...)
+		}
 	}
+}
 
+// abortRollbacks marks every target that still needs to finish rolling back
+// as failed, and returns an ErrRollbackAborted for each of them.
+func (eng *Engine) abortRollbacks() (errs []*TargetErr) {
+	for _, name := range eng.graph.order(eng.Targets) {
+		status := eng.statuses[name]
+		switch status.getRollback() {
+		case RollbackDone, RollbackFailed:
+			continue
+		}
+		if !status.needsRollback() {
+			continue
+		}
+
+		status.setRollback(RollbackFailed)
+		status.addErr(ErrRollbackAborted)
+		errs = append(errs, &TargetErr{Target: name, Err: ErrRollbackAborted})
+	}
 	return
 }
 
-// fanIn runs fn against every Shipper and fans in all errors from their
-// returned channels onto a single aggregate channel, which it returns.
-func (eng *Engine) fanIn(fn func(shipper Shipper) chan error) chan error {
+// walk runs fn against every Shipper and fans in all errors from their
+// returned channels onto a single aggregate channel, which it returns. Each
+// target waits for the targets listed for it in waitOn to finish before it
+// starts, and done is called once its channel has been drained. Every error
+// is also reported as an EventError. If skipFailed is true, a target is
+// skipped when any of the targets it waited on failed or was skipped itself.
+func (eng *Engine) walk(
+	waitOn map[string][]string,
+	skipFailed bool,
+	fn func(target string, shipper Shipper) chan error,
+	done func(target string, ok bool),
+) chan *TargetErr {
 	var wg sync.WaitGroup
-	aggregator := make(chan error)
+	aggregator := make(chan *TargetErr)
 
-	for target, shipper := range eng.Shippers {
+	nodes := make(map[string]*walkNode, len(eng.Targets))
+	for target := range eng.Targets {
+		nodes[target] = &walkNode{done: make(chan struct{})}
+	}
+
+	for target, t := range eng.Targets {
 		wg.Add(1)
-		go func(target string, shipper Shipper) {
+		go func(target string, shipper Shipper, node *walkNode) {
 			defer wg.Done()
+			defer close(node.done)
 
-			fmt.Printf("%v: Running target\n", target)
-			for err := range fn(shipper) {
-				aggregator <- err
+			for _, prev := range waitOn[target] {
+				<-nodes[prev].done
+				if skipFailed && !nodes[prev].ok {
+					eng.report(Event{
+						Type:    EventTargetSkipped,
+						Target:  target,
+						Message: fmt.Sprintf("\"%v\" did not complete", prev),
+					})
+					return
+				}
 			}
-			fmt.Printf("%v: Completed target\n", target)
-		}(target, shipper)
+
+			ok := true
+			for err := range fn(target, shipper) {
+				ok = false
+				eng.report(Event{Type: EventError, Target: target, Error: err.Error()})
+				aggregator <- &TargetErr{Target: target, Err: err}
+			}
+			node.ok = ok
+			done(target, ok)
+		}(target, t.Shipper, nodes[target])
 	}
 
 	// Wait for all sub processes to finish and send a signal to the parent
@@ -105,3 +315,23 @@ func (eng *Engine) fanIn(fn func(shipper Shipper) chan error) chan error {
 
 	return aggregator
 }
+
+// walkNode tracks a single target during a walk. ok is only written before
+// done is closed, so it is safe to read once done has been closed.
+type walkNode struct {
+	done chan struct{}
+	ok   bool
+}
+
+// report timestamps ev and sends it to the Engine's Reporter.
+func (eng *Engine) report(ev Event) {
+	ev.Time = time.Now()
+	eng.Reporter.Report(ev)
+}
+
+// closedErrCh returns a closed channel, for targets with nothing to do.
+func closedErrCh() chan error {
+	ch := make(chan error)
+	close(ch)
+	return ch
+}
@@ -0,0 +1,387 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// journal records the order that fake shippers are called in, across every
+// target of a deploy.
+type journal struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (j *journal) add(entry string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.entries = append(j.entries, entry)
+}
+
+func (j *journal) get() []string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]string(nil), j.entries...)
+}
+
+// fakeShipper ships by calling ship with the number of the attempt, starting
+// at 1, and returning its errors. It marks the target as mutated first when
+// mutate is set, and its Rollback fails with rollbackErr.
+type fakeShipper struct {
+	name    string
+	journal *journal
+
+	ship        func(ctx context.Context, attempt int) []error
+	mutate      bool
+	rollbackErr error
+
+	mu       sync.Mutex
+	attempts int
+}
+
+func (fs *fakeShipper) ShipIt(ctx context.Context) chan error {
+	fs.mu.Lock()
+	fs.attempts++
+	attempt := fs.attempts
+	fs.mu.Unlock()
+
+	fs.journal.add("ship " + fs.name)
+	if fs.mutate {
+		Mutating(ctx)
+	}
+
+	var errs []error
+	if fs.ship != nil {
+		errs = fs.ship(ctx, attempt)
+	}
+	return sendAll(errs)
+}
+
+func (fs *fakeShipper) Rollback(ctx context.Context) chan error {
+	fs.journal.add("rollback " + fs.name)
+	if fs.rollbackErr != nil {
+		return sendAll([]error{fs.rollbackErr})
+	}
+	return closedErrCh()
+}
+
+func (fs *fakeShipper) getAttempts() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.attempts
+}
+
+func sendAll(errs []error) chan error {
+	ch := make(chan error, len(errs))
+	for _, err := range errs {
+		ch <- err
+	}
+	close(ch)
+	return ch
+}
+
+// fails returns a ship func that always fails with err.
+func fails(err error) func(context.Context, int) []error {
+	return func(context.Context, int) []error {
+		return []error{err}
+	}
+}
+
+// testReporter records every event and throws away command output.
+type testReporter struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (tr *testReporter) Report(ev Event) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.events = append(tr.events, ev)
+}
+
+func (tr *testReporter) Output() io.Writer {
+	return ioutil.Discard
+}
+
+func (tr *testReporter) skipped() (targets []string) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, ev := range tr.events {
+		if ev.Type == EventTargetSkipped {
+			targets = append(targets, ev.Target)
+		}
+	}
+	return
+}
+
+type testApprover bool
+
+func (ta testApprover) Approve(ctx context.Context, target, plan string) (bool, error) {
+	return bool(ta), nil
+}
+
+// testDeploy holds a set of fake targets that share a journal.
+type testDeploy struct {
+	journal  *journal
+	shippers map[string]*fakeShipper
+	targets  Targets
+	reporter *testReporter
+}
+
+func newTestDeploy() *testDeploy {
+	return &testDeploy{
+		journal:  &journal{},
+		shippers: make(map[string]*fakeShipper),
+		targets:  make(Targets),
+		reporter: &testReporter{},
+	}
+}
+
+// add creates a target named name, shipped by shipper, that depends on deps.
+func (td *testDeploy) add(name string, shipper *fakeShipper, deps ...string) *Target {
+	shipper.name = name
+	shipper.journal = td.journal
+	td.shippers[name] = shipper
+
+	target := &Target{Shipper: shipper, DependsOn: deps}
+	td.targets[name] = target
+	return target
+}
+
+func (td *testDeploy) run(t *testing.T, approver Approver) (*Engine, *DeployErr) {
+	eng := NewEngine(td.targets)
+	eng.Reporter = td.reporter
+	eng.Approver = approver
+
+	err := eng.Run(Options{Env: "test", Version: "v1"})
+	if err == nil {
+		return eng, nil
+	}
+
+	deployErr, ok := err.(*DeployErr)
+	if !ok {
+		t.Fatalf("Run failed with %T, expected a *DeployErr: %v", err, err)
+	}
+	return eng, deployErr
+}
+
+// rollbacks returns the targets that were rolled back, in order.
+func (td *testDeploy) rollbacks() (targets []string) {
+	for _, entry := range td.journal.get() {
+		if strings.HasPrefix(entry, "rollback ") {
+			targets = append(targets, strings.TrimPrefix(entry, "rollback "))
+		}
+	}
+	return
+}
+
+func summaryFor(eng *Engine, target string) TargetSummary {
+	for _, ts := range eng.Summary() {
+		if ts.Target == target {
+			return ts
+		}
+	}
+	return TargetSummary{}
+}
+
+func TestNewGraphRejectsCycles(t *testing.T) {
+	td := newTestDeploy()
+	td.add("web", &fakeShipper{}, "api")
+	td.add("api", &fakeShipper{}, "worker")
+	td.add("worker", &fakeShipper{}, "web")
+
+	_, err := newGraph(td.targets)
+	if _, ok := err.(CycleErr); !ok {
+		t.Fatalf("Expected a CycleErr, got %T: %v", err, err)
+	}
+
+	if err := NewEngine(td.targets).Run(Options{}); err == nil {
+		t.Error("Run accepted targets that depend on each other")
+	}
+	if entries := td.journal.get(); len(entries) > 0 {
+		t.Errorf("Targets were shipped despite the cycle: %v", entries)
+	}
+}
+
+func TestNewGraphRejectsUnknownDependencies(t *testing.T) {
+	td := newTestDeploy()
+	td.add("web", &fakeShipper{}, "database")
+
+	_, err := newGraph(td.targets)
+	depErr, ok := err.(DependencyErr)
+	if !ok {
+		t.Fatalf("Expected a DependencyErr, got %T: %v", err, err)
+	}
+	if depErr.Target != "web" || depErr.Dependency != "database" {
+		t.Errorf("Expected web's missing dependency on database, got %+v", depErr)
+	}
+}
+
+func TestDependentsAreSkippedAfterAFailure(t *testing.T) {
+	td := newTestDeploy()
+	td.add("database", &fakeShipper{ship: fails(errors.New("migration failed"))})
+	td.add("api", &fakeShipper{}, "database")
+	td.add("web", &fakeShipper{}, "api")
+
+	eng, err := td.run(t, nil)
+	if err == nil {
+		t.Fatal("The deploy succeeded, expected the database to fail it")
+	}
+
+	for _, name := range []string{"api", "web"} {
+		if attempts := td.shippers[name].getAttempts(); attempts != 0 {
+			t.Errorf("%v was shipped %d time(s) after its dependency failed", name, attempts)
+		}
+		if state := summaryFor(eng, name).State; state != StateNotStarted.String() {
+			t.Errorf("%v is %q, expected %q", name, state, StateNotStarted)
+		}
+	}
+
+	if skipped := td.reporter.skipped(); len(skipped) != 2 {
+		t.Errorf("Expected api and web to be reported as skipped, got %v", skipped)
+	}
+}
+
+func TestRollbackOnlyChangedTargetsInReverseOrder(t *testing.T) {
+	td := newTestDeploy()
+	td.add("database", &fakeShipper{})
+	td.add("api", &fakeShipper{}, "database")
+	td.add("web", &fakeShipper{mutate: true, ship: fails(errors.New("bad image"))}, "api")
+
+	// Independent of the others, and fails before it changes anything.
+	td.add("cdn", &fakeShipper{ship: fails(errors.New("bad credentials"))})
+
+	eng, err := td.run(t, nil)
+	if err == nil {
+		t.Fatal("The deploy succeeded, expected web and cdn to fail it")
+	}
+	if code := err.ExitCode(); code != ExitDeployFailed {
+		t.Errorf("Exit code is %d after a clean rollback, expected %d", code, ExitDeployFailed)
+	}
+
+	expected := []string{"web", "api", "database"}
+	if rollbacks := td.rollbacks(); !reflect.DeepEqual(rollbacks, expected) {
+		t.Errorf("Rolled back %v, expected %v", rollbacks, expected)
+	}
+
+	for _, name := range expected {
+		if rollback := summaryFor(eng, name).Rollback; rollback != RollbackDone.String() {
+			t.Errorf("%v's rollback is %q, expected %q", name, rollback, RollbackDone)
+		}
+	}
+	if rollback := summaryFor(eng, "cdn").Rollback; rollback != RollbackNotNeeded.String() {
+		t.Errorf("cdn's rollback is %q, expected %q", rollback, RollbackNotNeeded)
+	}
+}
+
+func TestFailedRollbackExitCode(t *testing.T) {
+	td := newTestDeploy()
+	td.add("database", &fakeShipper{rollbackErr: errors.New("can't restore the backup")})
+	td.add("api", &fakeShipper{ship: fails(errors.New("bad image"))}, "database")
+
+	eng, err := td.run(t, nil)
+	if err == nil {
+		t.Fatal("The deploy succeeded, expected api to fail it")
+	}
+
+	if len(err.Rollback) != 1 || err.Rollback[0].Target != "database" {
+		t.Errorf("Expected the database's rollback to fail, got %v", err.Rollback)
+	}
+	if code := err.ExitCode(); code != ExitRollbackFailed {
+		t.Errorf("Exit code is %d, expected %d", code, ExitRollbackFailed)
+	}
+	if rollback := summaryFor(eng, "database").Rollback; rollback != RollbackFailed.String() {
+		t.Errorf("The database's rollback is %q, expected %q", rollback, RollbackFailed)
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	td := newTestDeploy()
+	target := td.add("api", &fakeShipper{
+		ship: func(ctx context.Context, attempt int) []error {
+			if attempt == 1 {
+				return []error{Transient(errors.New("connection refused"))}
+			}
+			return nil
+		},
+	})
+	target.Retries = 2
+	target.Backoff = time.Millisecond
+
+	if _, err := td.run(t, nil); err != nil {
+		t.Fatalf("The deploy failed: %v", err)
+	}
+	if attempts := td.shippers["api"].getAttempts(); attempts != 2 {
+		t.Errorf("api was shipped %d time(s), expected 2", attempts)
+	}
+}
+
+func TestDontRetryOtherErrors(t *testing.T) {
+	td := newTestDeploy()
+	target := td.add("api", &fakeShipper{ship: fails(errors.New("bad image"))})
+	target.Retries = 2
+	target.Backoff = time.Millisecond
+
+	if _, err := td.run(t, nil); err == nil {
+		t.Fatal("The deploy succeeded, expected api to fail it")
+	}
+	if attempts := td.shippers["api"].getAttempts(); attempts != 1 {
+		t.Errorf("api was shipped %d time(s), expected 1", attempts)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	td := newTestDeploy()
+	target := td.add("api", &fakeShipper{
+		ship: func(ctx context.Context, attempt int) []error {
+			<-ctx.Done()
+			return []error{ctx.Err()}
+		},
+	})
+	target.Timeout = 10 * time.Millisecond
+
+	_, err := td.run(t, nil)
+	if err == nil {
+		t.Fatal("The deploy succeeded, expected api to time out")
+	}
+
+	var timedOut bool
+	for _, targetErr := range err.Deploy {
+		if transient, ok := targetErr.Err.(transientErr); ok {
+			if timeoutErr, ok := transient.error.(TimeoutErr); ok && timeoutErr.Timeout == target.Timeout {
+				timedOut = true
+			}
+		}
+	}
+	if !timedOut {
+		t.Errorf("Expected a TimeoutErr for %v, got %v", target.Timeout, err.Deploy)
+	}
+}
+
+func TestDeclinedApprovalRollsBack(t *testing.T) {
+	td := newTestDeploy()
+	td.add("database", &fakeShipper{})
+	td.add("api", &fakeShipper{}, "database").Approve = true
+
+	_, err := td.run(t, testApprover(false))
+	if err == nil {
+		t.Fatal("The deploy succeeded, expected the declined approval to fail it")
+	}
+
+	if !declined(err.Deploy) {
+		t.Errorf("Expected ErrApprovalDeclined, got %v", err.Deploy)
+	}
+	if attempts := td.shippers["api"].getAttempts(); attempts != 0 {
+		t.Errorf("api was shipped %d time(s) without approval", attempts)
+	}
+	if rollbacks := td.rollbacks(); !reflect.DeepEqual(rollbacks, []string{"database"}) {
+		t.Errorf("Rolled back %v, expected the database", rollbacks)
+	}
+}
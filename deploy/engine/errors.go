@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrRollbackAborted = errors.New("The rollback was aborted before this target finished rolling back")
+)
+
+// Process exit codes for a failed deploy, see DeployErr.ExitCode.
+const (
+	ExitDeployFailed   = 1
+	ExitRollbackFailed = 3
+)
+
+// TargetErr is an error reported by the shipper for a particular target.
+// Target is empty for errors that apply to the whole deploy, such as a
+// failed global hook.
+type TargetErr struct {
+	Target string
+	Err    error
+}
+
+func (te *TargetErr) Error() string {
+	if te.Target == "" {
+		return te.Err.Error()
+	}
+	return fmt.Sprintf("%v: %v", te.Target, te.Err)
+}
+
+// DeployErr is returned by Engine.Run when a deploy fails. It carries every
+// error reported while deploying along with every error reported while
+// rolling back, so a failed rollback is never hidden behind the original
+// failure.
+type DeployErr struct {
+	Deploy   []*TargetErr
+	Rollback []*TargetErr
+
+	// Interrupted is set when the deploy was stopped by a signal.
+	Interrupted bool
+}
+
+func (de *DeployErr) Error() string {
+	buffer := &bytes.Buffer{}
+	if de.Interrupted {
+		fmt.Fprintln(buffer, "The deploy was interrupted.")
+	}
+	fmt.Fprintln(buffer, "The deploy failed:")
+	for _, err := range de.Deploy {
+		fmt.Fprintf(buffer, "  %v\n", err)
+	}
+
+	if de.RollbackFailed() {
+		fmt.Fprintln(buffer, "The rollback failed as well, check the state of these targets by hand:")
+		for _, err := range de.Rollback {
+			fmt.Fprintf(buffer, "  %v\n", err)
+		}
+	}
+	return buffer.String()
+}
+
+// RollbackFailed reports whether any target failed to roll back.
+func (de *DeployErr) RollbackFailed() bool {
+	return len(de.Rollback) > 0
+}
+
+// ExitCode distinguishes a deploy that was cleanly rolled back from one that
+// may have left things in a broken state.
+func (de *DeployErr) ExitCode() int {
+	if de.RollbackFailed() {
+		return ExitRollbackFailed
+	}
+	return ExitDeployFailed
+}
+
+// countTargets returns the number of different targets in errs.
+func countTargets(errs []*TargetErr) int {
+	targets := make(map[string]bool, len(errs))
+	for _, err := range errs {
+		targets[err.Target] = true
+	}
+	return len(targets)
+}
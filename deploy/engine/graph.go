@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DependencyErr is returned when a target depends on a target that is not
+// defined in the same environment.
+type DependencyErr struct {
+	Target     string
+	Dependency string
+}
+
+func (de DependencyErr) Error() string {
+	return fmt.Sprintf(
+		"Target \"%v\" depends on \"%v\", which is not a deploy target",
+		de.Target,
+		de.Dependency,
+	)
+}
+
+// CycleErr is returned when the dependencies between targets form a cycle.
+// Path lists the targets in the cycle, starting and ending with the same one.
+type CycleErr struct {
+	Path []string
+}
+
+func (ce CycleErr) Error() string {
+	return fmt.Sprintf(
+		"Deploy targets have a dependency cycle: %v",
+		strings.Join(ce.Path, " -> "),
+	)
+}
+
+// graph records the dependencies between targets in both directions so that
+// deploys can walk it forwards and rollbacks can walk it backwards.
+type graph struct {
+	dependencies map[string][]string
+	dependents   map[string][]string
+}
+
+// newGraph builds the dependency graph for targets and verifies that every
+// dependency exists and that there are no cycles.
+func newGraph(targets Targets) (*graph, error) {
+	g := &graph{
+		dependencies: make(map[string][]string, len(targets)),
+		dependents:   make(map[string][]string, len(targets)),
+	}
+
+	for _, name := range sortedNames(targets) {
+		for _, dep := range targets[name].DependsOn {
+			if _, ok := targets[dep]; !ok {
+				return nil, DependencyErr{Target: name, Dependency: dep}
+			}
+			g.dependencies[name] = append(g.dependencies[name], dep)
+			g.dependents[dep] = append(g.dependents[dep], name)
+		}
+	}
+
+	if err := g.checkCycles(sortedNames(targets)); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// order returns the target names sorted so that every target comes after all
+// of its dependencies. Ties are broken alphabetically so the order is stable.
+func (g *graph) order(targets Targets) []string {
+	remaining := make(map[string]int, len(targets))
+	for name := range targets {
+		remaining[name] = len(g.dependencies[name])
+	}
+
+	var ordered []string
+	for len(remaining) > 0 {
+		var ready []string
+		for name, count := range remaining {
+			if count == 0 {
+				ready = append(ready, name)
+			}
+		}
+		sort.Strings(ready)
+
+		for _, name := range ready {
+			delete(remaining, name)
+			for _, dependent := range g.dependents[name] {
+				remaining[dependent]--
+			}
+		}
+		ordered = append(ordered, ready...)
+	}
+	return ordered
+}
+
+// checkCycles runs a depth first search from every target and returns a
+// CycleErr for the first cycle that it finds.
+func (g *graph) checkCycles(names []string) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := make(map[string]int, len(names))
+	var path []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			// Trim the path down to where the cycle begins.
+			for idx, n := range path {
+				if n == name {
+					return CycleErr{Path: append(path[idx:], name)}
+				}
+			}
+		}
+
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range g.dependencies[name] {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedNames(targets Targets) []string {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
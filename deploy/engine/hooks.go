@@ -0,0 +1,152 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Hook names, as passed to hooks in FORGE_HOOK.
+const (
+	HookBefore     = "before"
+	HookAfter      = "after"
+	HookOnFailure  = "on_failure"
+	HookOnRollback = "on_rollback"
+)
+
+// Outcomes passed to hooks in FORGE_OUTCOME.
+const (
+	outcomePending        = "pending"
+	outcomeSucceeded      = "succeeded"
+	outcomeFailed         = "failed"
+	outcomeRolledBack     = "rolled_back"
+	outcomeRollbackFailed = "rollback_failed"
+)
+
+// Hooks are shell commands that run around a whole deploy, or around a single
+// target. Before and After hooks that fail make the deploy, or the target,
+// fail. Failures in OnFailure and OnRollback hooks are only reported.
+type Hooks struct {
+	Before     []string
+	After      []string
+	OnFailure  []string
+	OnRollback []string
+}
+
+// HookErr is returned when a hook command fails.
+type HookErr struct {
+	Hook    string
+	Command string
+	Err     error
+}
+
+func (he HookErr) Error() string {
+	return fmt.Sprintf("The %v hook %q failed: %v", he.Hook, he.Command, he.Err)
+}
+
+// runHooks runs every command with bash, in order, and stops at the first
+// one that fails. The target name, version and outcome are passed to the
+// commands as environment variables. target is empty for the global hooks.
+func (eng *Engine) runHooks(
+	ctx context.Context,
+	hook string,
+	commands []string,
+	target string,
+	outcome string,
+) error {
+	opts := OptionsFromContext(ctx)
+	env := append(
+		os.Environ(),
+		"FORGE_HOOK="+hook,
+		"FORGE_ENV="+opts.Env,
+		"FORGE_TARGET="+target,
+		"FORGE_VERSION="+opts.Version,
+		"FORGE_OUTCOME="+outcome,
+	)
+
+	for _, command := range commands {
+		eng.report(Event{
+			Type:    EventProgress,
+			Target:  target,
+			Message: fmt.Sprintf("Running %v hook: %v", hook, command),
+		})
+
+		cmd := exec.CommandContext(ctx, "bash", "-c", command)
+		cmd.Env = env
+		cmd.Stdout = Output(ctx)
+		cmd.Stderr = os.Stderr
+
+		if err := cmd.Run(); err != nil {
+			return HookErr{Hook: hook, Command: command, Err: err}
+		}
+	}
+	return nil
+}
+
+// runReportOnlyHooks runs hooks whose failures shouldn't change the outcome of
+// the deploy, and reports any failure as a warning.
+func (eng *Engine) runReportOnlyHooks(
+	ctx context.Context,
+	hook string,
+	commands []string,
+	target string,
+	outcome string,
+) {
+	if err := eng.runHooks(ctx, hook, commands, target, outcome); err != nil {
+		eng.report(Event{Type: EventWarning, Target: target, Message: err.Error()})
+	}
+}
+
+// shipWithHooks ships the target between its before and after hooks, and runs
+// its on_failure hooks if it fails. The on_failure hooks run with failureCtx,
+// since ctx has usually been canceled by then, e.g. by an interrupt.
+func (eng *Engine) shipWithHooks(ctx, failureCtx context.Context, name string, target *Target) chan error {
+	ch := make(chan error)
+
+	go func() {
+		defer close(ch)
+
+		if err := eng.runHooks(ctx, HookBefore, target.Hooks.Before, name, outcomePending); err != nil {
+			ch <- err
+			eng.runReportOnlyHooks(failureCtx, HookOnFailure, target.Hooks.OnFailure, name, outcomeFailed)
+			return
+		}
+
+		failed := false
+		for err := range eng.ship(ctx, name, target) {
+			failed = true
+			ch <- err
+		}
+
+		if !failed {
+			err := eng.runHooks(ctx, HookAfter, target.Hooks.After, name, outcomeSucceeded)
+			if err == nil {
+				return
+			}
+			ch <- err
+		}
+		eng.runReportOnlyHooks(failureCtx, HookOnFailure, target.Hooks.OnFailure, name, outcomeFailed)
+	}()
+
+	return ch
+}
+
+// rollbackWithHooks rolls the target back and then runs its on_rollback
+// hooks.
+func (eng *Engine) rollbackWithHooks(ctx context.Context, name string, target *Target) chan error {
+	ch := make(chan error)
+
+	go func() {
+		defer close(ch)
+
+		outcome := outcomeRolledBack
+		for err := range target.Shipper.Rollback(ctx) {
+			outcome = outcomeRollbackFailed
+			ch <- err
+		}
+		eng.runReportOnlyHooks(ctx, HookOnRollback, target.Hooks.OnRollback, name, outcome)
+	}()
+
+	return ch
+}
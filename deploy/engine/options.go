@@ -2,20 +2,27 @@ package engine
 
 import (
 	"context"
+	"errors"
 )
 
 const (
 	optionsKey = "deploy.options"
 )
 
+// ErrNoVersion is returned when a deploy needs a version and doesn't have
+// one.
+var ErrNoVersion = errors.New("No version to deploy, pass one with --version")
+
 // Options are runtime configurations that are disseminated to every shipper
 // via the context passed to `Shipper.ShipIt` and `Shipper.Rollback`.
 type Options struct {
-	AppEngine struct {
-		ImageTag string
-	}
-
+	// Env is the environment being deployed to.
+	Env     string
 	Version string
+
+	// Vars are the variables set with --var and the Forgefile's vars
+	// blocks. Shippers read them with Var.
+	Vars map[string]string
 }
 
 // InContext embeds the Options into the ctx argument and returns a new
@@ -39,3 +46,9 @@ func OptionsFromContext(ctx context.Context) Options {
 
 	return Options{}
 }
+
+// Var returns the value of the variable name from the Options in ctx, or an
+// empty string if it isn't set.
+func Var(ctx context.Context, name string) string {
+	return OptionsFromContext(ctx).Vars[name]
+}
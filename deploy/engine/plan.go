@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const noPlanMessage = "This shipper can't describe its changes ahead of time, it will run its normal deploy."
+
+// Plan asks every target what it would do if it were deployed with opts and
+// prints the answers in dependency order. Nothing is shipped. Targets whose
+// shippers don't implement Planner are listed with a fallback message.
+func (eng *Engine) Plan(opts Options) error {
+	ctx := ContextForOptions(opts)
+
+	g, err := newGraph(eng.Targets)
+	if err != nil {
+		return err
+	}
+
+	var finalErr error
+	for _, name := range g.order(eng.Targets) {
+		target := eng.Targets[name]
+
+		fmt.Printf("%v:\n", name)
+		if len(target.DependsOn) > 0 {
+			fmt.Printf("    (after %v)\n", strings.Join(target.DependsOn, ", "))
+		}
+
+		if target.Approve {
+			fmt.Println("    (requires approval)")
+		}
+
+		plan, err := planFor(ctx, target)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v: %v\n", name, err)
+			finalErr = err
+			continue
+		}
+		fmt.Printf("%v\n\n", indent(strings.TrimRight(plan, "\n")))
+	}
+
+	return finalErr
+}
+
+// planFor returns the target's plan, or a fallback message if its shipper
+// isn't a Planner.
+func planFor(ctx context.Context, target *Target) (string, error) {
+	planner, ok := target.Shipper.(Planner)
+	if !ok {
+		return noPlanMessage, nil
+	}
+	return planner.Plan(ctx)
+}
+
+func indent(text string) string {
+	return "    " + strings.Replace(text, "\n", "\n    ", -1)
+}
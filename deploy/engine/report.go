@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	reporterKey = "deploy.reporter"
+)
+
+// EventType identifies what happened in an Event.
+type EventType string
+
+const (
+	EventDeployStarted    EventType = "deploy_started"
+	EventDeployFinished   EventType = "deploy_finished"
+	EventTargetStarted    EventType = "target_started"
+	EventTargetSkipped    EventType = "target_skipped"
+	EventTargetCompleted  EventType = "target_completed"
+	EventProgress         EventType = "progress"
+	EventWarning          EventType = "warning"
+	EventError            EventType = "error"
+	EventRollbackStarted  EventType = "rollback_started"
+	EventRollbackFinished EventType = "rollback_finished"
+)
+
+// An Event is a single step in the life of a deploy. Target is empty for
+// events that apply to the deploy as a whole.
+type Event struct {
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+	Target  string    `json:"target,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Error   string    `json:"error,omitempty"`
+
+	// Summary is only set on EventDeployFinished.
+	Summary []TargetSummary `json:"summary,omitempty"`
+}
+
+// TargetSummary is the final outcome of a single target.
+type TargetSummary struct {
+	Target   string `json:"target"`
+	State    string `json:"state"`
+	Rollback string `json:"rollback"`
+	Error    string `json:"error,omitempty"`
+}
+
+// A Reporter receives every Event emitted during a deploy. Reporters must be
+// safe to use from multiple goroutines.
+type Reporter interface {
+	Report(Event)
+
+	// Output is where shippers should send the output of the commands that
+	// they run, so that it doesn't get mixed in with the Reporter's own.
+	Output() io.Writer
+}
+
+// WithReporter embeds the Reporter into the ctx argument and returns a new
+// context.
+func WithReporter(ctx context.Context, r Reporter) context.Context {
+	return context.WithValue(ctx, reporterKey, r)
+}
+
+// ReporterFromContext extracts the Reporter from a context, or returns a
+// ConsoleReporter that writes to stdout.
+func ReporterFromContext(ctx context.Context) Reporter {
+	if r, ok := ctx.Value(reporterKey).(Reporter); ok {
+		return r
+	}
+	return NewConsoleReporter(os.Stdout)
+}
+
+// Progress reports a step of progress for the target being shipped with ctx.
+func Progress(ctx context.Context, format string, args ...interface{}) {
+	reportForTarget(ctx, EventProgress, fmt.Sprintf(format, args...))
+}
+
+// Warn reports a problem that did not stop the target being shipped with ctx.
+func Warn(ctx context.Context, format string, args ...interface{}) {
+	reportForTarget(ctx, EventWarning, fmt.Sprintf(format, args...))
+}
+
+// Output returns the writer that shippers should send command output to.
+func Output(ctx context.Context) io.Writer {
+	return ReporterFromContext(ctx).Output()
+}
+
+func reportForTarget(ctx context.Context, typ EventType, message string) {
+	ev := Event{Type: typ, Time: time.Now(), Message: message}
+	if status, ok := ctx.Value(targetKey).(*targetStatus); ok {
+		ev.Target = status.name
+	}
+	ReporterFromContext(ctx).Report(ev)
+}
+
+// ConsoleReporter writes events as human readable lines.
+type ConsoleReporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewConsoleReporter(out io.Writer) *ConsoleReporter {
+	return &ConsoleReporter{out: out}
+}
+
+func (cr *ConsoleReporter) Report(ev Event) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	switch ev.Type {
+	case EventDeployStarted:
+		fmt.Fprintln(cr.out, ev.Message)
+	case EventTargetStarted:
+		fmt.Fprintf(cr.out, "%v: Running target\n", ev.Target)
+	case EventTargetSkipped:
+		fmt.Fprintf(cr.out, "%v: Skipping target, %v\n", ev.Target, ev.Message)
+	case EventTargetCompleted:
+		fmt.Fprintf(cr.out, "%v: Completed target (%v)\n", ev.Target, ev.Message)
+	case EventProgress:
+		fmt.Fprintf(cr.out, "%v%v\n", targetPrefix(ev.Target), ev.Message)
+	case EventWarning:
+		fmt.Fprintf(os.Stderr, "WARNING: %v%v\n", targetPrefix(ev.Target), ev.Message)
+	case EventError:
+		fmt.Fprintf(os.Stderr, "ERROR: %v%v\n", targetPrefix(ev.Target), ev.Error)
+	case EventRollbackStarted:
+		if ev.Target != "" {
+			fmt.Fprintf(cr.out, "%v: Rolling back target\n", ev.Target)
+			break
+		}
+		fmt.Fprintln(cr.out, strings.Repeat("*", 80))
+		fmt.Fprintln(cr.out, "An error was encountered while deploying the application")
+		fmt.Fprintln(cr.out, ev.Message)
+		fmt.Fprintln(cr.out, strings.Repeat("*", 80))
+	case EventRollbackFinished:
+		if ev.Target != "" {
+			fmt.Fprintf(cr.out, "%v: Finished rolling back target\n", ev.Target)
+		}
+	case EventDeployFinished:
+		if ev.Error != "" {
+			cr.printSummary(ev.Summary)
+		}
+	}
+}
+
+func (cr *ConsoleReporter) Output() io.Writer {
+	return cr.out
+}
+
+// targetPrefix labels a line with the target it's about, if there is one.
+func targetPrefix(target string) string {
+	if target == "" {
+		return ""
+	}
+	return target + ": "
+}
+
+// printSummary writes a table of every target's deploy state and the result
+// of rolling it back.
+func (cr *ConsoleReporter) printSummary(summary []TargetSummary) {
+	table := tabwriter.NewWriter(cr.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET\tSTATE\tROLLBACK")
+
+	for _, ts := range summary {
+		result := ts.Rollback
+		if ts.Error != "" {
+			result = fmt.Sprintf("%v: %v", result, ts.Error)
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\n", ts.Target, ts.State, result)
+	}
+
+	table.Flush()
+}
+
+// MultiReporter sends every event to each of its Reporters. Command output
+// goes to the first one.
+type MultiReporter []Reporter
+
+func (mr MultiReporter) Report(ev Event) {
+	for _, r := range mr {
+		r.Report(ev)
+	}
+}
+
+func (mr MultiReporter) Output() io.Writer {
+	return mr[0].Output()
+}
+
+// JSONReporter writes every event as a line of JSON, which makes the deploy
+// easy to follow from CI. Command output from the shippers is sent to
+// cmdOutput so that it can't corrupt the stream.
+type JSONReporter struct {
+	mu        sync.Mutex
+	enc       *json.Encoder
+	cmdOutput io.Writer
+}
+
+func NewJSONReporter(out, cmdOutput io.Writer) *JSONReporter {
+	return &JSONReporter{
+		enc:       json.NewEncoder(out),
+		cmdOutput: cmdOutput,
+	}
+}
+
+func (jr *JSONReporter) Report(ev Event) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	if err := jr.enc.Encode(ev); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: failed to write deploy event: %v\n", err)
+	}
+}
+
+func (jr *JSONReporter) Output() io.Writer {
+	return jr.cmdOutput
+}
@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// TimeoutErr is reported when a single attempt at shipping a target takes
+// longer than the target's Timeout.
+type TimeoutErr struct {
+	Timeout time.Duration
+}
+
+func (te TimeoutErr) Error() string {
+	return fmt.Sprintf("Timed out after %v", te.Timeout)
+}
+
+// Timeouts are always worth another try.
+func (te TimeoutErr) Temporary() bool {
+	return true
+}
+
+// Transient marks err as a temporary failure, such as a network error, that
+// might succeed if the target is shipped again. Only transient failures are
+// retried.
+func Transient(err error) error {
+	if err == nil {
+		return nil
+	}
+	return transientErr{err}
+}
+
+type transientErr struct {
+	error
+}
+
+func (te transientErr) Temporary() bool {
+	return true
+}
+
+// isTransient follows the same convention as net.Error: errors with a
+// Temporary method that returns true are transient.
+func isTransient(err error) bool {
+	temp, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && temp.Temporary()
+}
+
+// ship runs ShipIt for the target, limiting every attempt to the target's
+// Timeout. If an attempt fails and all of its errors are transient, the
+// target is shipped again, up to Retries more times. The wait between
+// attempts starts at Backoff and doubles after every retry.
+func (eng *Engine) ship(ctx context.Context, name string, target *Target) chan error {
+	ch := make(chan error)
+
+	go func() {
+		defer close(ch)
+
+		backoff := target.Backoff
+		for attempt := 0; ; attempt++ {
+			errs := eng.attempt(ctx, target)
+			if len(errs) == 0 {
+				return
+			}
+
+			if attempt >= target.Retries || ctx.Err() != nil || !allTransient(errs) {
+				for _, err := range errs {
+					ch <- err
+				}
+				return
+			}
+
+			eng.report(Event{
+				Type:    EventWarning,
+				Target:  name,
+				Message: fmt.Sprintf("Attempt %d failed (%v), retrying in %v", attempt+1, errs[0], backoff),
+			})
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				ch <- ctx.Err()
+				return
+			}
+			backoff *= 2
+		}
+	}()
+
+	return ch
+}
+
+// attempt ships the target once and collects its errors.
+func (eng *Engine) attempt(ctx context.Context, target *Target) (errs []error) {
+	attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+	if target.Timeout > 0 {
+		attemptCtx, cancel = context.WithTimeout(ctx, target.Timeout)
+	}
+	defer cancel()
+
+	for err := range target.Shipper.ShipIt(attemptCtx) {
+		errs = append(errs, err)
+	}
+
+	// Whatever the shipper reported, the real problem is that it ran out of
+	// time. That's only true if the parent context is still alive, though.
+	if attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		errs = append([]error{TimeoutErr{target.Timeout}}, errs...)
+		for idx, err := range errs {
+			errs[idx] = Transient(err)
+		}
+	}
+	return
+}
+
+func allTransient(errs []error) bool {
+	for _, err := range errs {
+		if !isTransient(err) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,6 +1,10 @@
 package engine
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // A Shipper is anything that can ShipIt! How great is that!
 type Shipper interface {
@@ -9,3 +13,72 @@ type Shipper interface {
 }
 
 type Shippers map[string]Shipper
+
+// A Target is a Shipper along with the names of the other targets that must
+// ship successfully before it is allowed to start, and the limits on how
+// long and how often it may try to ship.
+type Target struct {
+	Shipper   Shipper
+	DependsOn []string
+
+	// Timeout limits every attempt at shipping the target, zero means no
+	// limit.
+	Timeout time.Duration
+
+	// Retries is how many more times to ship the target after a transient
+	// failure, waiting Backoff before the first retry and twice as long
+	// before each one after that.
+	Retries int
+	Backoff time.Duration
+
+	// Hooks run around this target only.
+	Hooks Hooks
+
+	// Approve makes the deploy wait for the Engine's Approver before the
+	// target ships.
+	Approve bool
+}
+
+type Targets map[string]*Target
+
+// A Planner is a Shipper that can describe what ShipIt would do without
+// changing anything. Shippers are not required to implement Planner.
+type Planner interface {
+	Plan(context.Context) (string, error)
+}
+
+// A VersionedShipper ships the version in Options.Version, e.g. as an image
+// tag, and can't ship without one. Shippers that don't implement
+// VersionedShipper work without a version.
+type VersionedShipper interface {
+	NeedsVersion() bool
+}
+
+// StatusUnknown is the version reported for targets that can't tell what is
+// deployed.
+const StatusUnknown = "unknown"
+
+// A Status describes what is currently deployed for a target. Fields that
+// don't apply to a shipper are left empty.
+type Status struct {
+	Version  string    `json:"version"`
+	Image    string    `json:"image,omitempty"`
+	Replicas *Replicas `json:"replicas,omitempty"`
+	Details  string    `json:"details,omitempty"`
+}
+
+// Replicas counts the copies of a target that are ready to serve.
+type Replicas struct {
+	Ready   int `json:"ready"`
+	Desired int `json:"desired"`
+}
+
+func (r *Replicas) String() string {
+	return fmt.Sprintf("%d/%d", r.Ready, r.Desired)
+}
+
+// An Inspector is a Shipper that can describe what is currently deployed for
+// its target. Shippers are not required to implement Inspector.
+type Inspector interface {
+	Status(context.Context) (Status, error)
+}
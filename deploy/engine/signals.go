@@ -0,0 +1,46 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals cancels the deploy with interrupt when the first SIGINT or
+// SIGTERM arrives, and calls abort when the second one does. The returned
+// function stops listening for signals.
+func (eng *Engine) handleSignals(interrupt, abort context.CancelFunc) (stop func()) {
+	sigCh := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case <-sigCh:
+		case <-done:
+			return
+		}
+		eng.report(Event{
+			Type:    EventWarning,
+			Message: "Interrupted, waiting for targets to stop and roll back. Interrupt again to abort immediately.",
+		})
+		interrupt()
+
+		select {
+		case <-sigCh:
+		case <-done:
+			return
+		}
+		eng.report(Event{
+			Type:    EventWarning,
+			Message: "Aborting, some targets may not have been rolled back.",
+		})
+		abort()
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
@@ -0,0 +1,175 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	targetKey = "deploy.target"
+)
+
+// TargetState is how far a target got during a deploy.
+type TargetState int
+
+const (
+	StateNotStarted TargetState = iota
+	StateInProgress
+	StateShipped
+	StateFailed
+)
+
+func (ts TargetState) String() string {
+	switch ts {
+	case StateNotStarted:
+		return "not started"
+	case StateInProgress:
+		return "in progress"
+	case StateShipped:
+		return "shipped"
+	case StateFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(ts))
+	}
+}
+
+// RollbackState is the outcome of rolling back a single target.
+type RollbackState int
+
+const (
+	RollbackNotNeeded RollbackState = iota
+	RollbackInProgress
+	RollbackDone
+	RollbackFailed
+)
+
+func (rs RollbackState) String() string {
+	switch rs {
+	case RollbackNotNeeded:
+		return "not needed"
+	case RollbackInProgress:
+		return "in progress"
+	case RollbackDone:
+		return "rolled back"
+	case RollbackFailed:
+		return "rollback failed"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(rs))
+	}
+}
+
+// targetStatus tracks a single target through a deploy and its rollback.
+type targetStatus struct {
+	mu   sync.Mutex
+	name string
+
+	state    TargetState
+	mutated  bool
+	rollback RollbackState
+	errs     []error
+}
+
+func (ts *targetStatus) getState() TargetState {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.state
+}
+
+func (ts *targetStatus) setState(state TargetState) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.state = state
+}
+
+func (ts *targetStatus) getRollback() RollbackState {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.rollback
+}
+
+func (ts *targetStatus) setRollback(rollback RollbackState) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.rollback = rollback
+}
+
+// addErr records an error from rolling back the target.
+func (ts *targetStatus) addErr(err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.errs = append(ts.errs, err)
+}
+
+func (ts *targetStatus) markMutated() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.mutated = true
+}
+
+// needsRollback reports whether the target may have changed anything. A
+// target that shipped always needs a rollback, but one that failed only
+// does if it reached a mutating step first.
+func (ts *targetStatus) needsRollback() bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	switch ts.state {
+	case StateShipped:
+		return true
+	case StateInProgress, StateFailed:
+		return ts.mutated
+	default:
+		return false
+	}
+}
+
+// InContext embeds the targetStatus into ctx so that shippers can report
+// their progress with Mutating, Progress and Warn.
+func (ts *targetStatus) InContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, targetKey, ts)
+}
+
+// Mutating records that the target being shipped with ctx is about to change
+// something, so it will have to be rolled back if the deploy fails. Shippers
+// should call it right before their first mutating step.
+func Mutating(ctx context.Context) {
+	if status, ok := ctx.Value(targetKey).(*targetStatus); ok {
+		status.markMutated()
+	}
+}
+
+// newStatuses creates a fresh targetStatus for every target.
+func newStatuses(targets Targets) map[string]*targetStatus {
+	statuses := make(map[string]*targetStatus, len(targets))
+	for name := range targets {
+		statuses[name] = &targetStatus{name: name}
+	}
+	return statuses
+}
+
+// Summary returns the outcome of every target from the last call to Run, in
+// dependency order. It returns nil if Run never got as far as shipping.
+func (eng *Engine) Summary() []TargetSummary {
+	if eng.graph == nil || eng.statuses == nil {
+		return nil
+	}
+
+	var summary []TargetSummary
+	for _, name := range eng.graph.order(eng.Targets) {
+		status := eng.statuses[name]
+		status.mu.Lock()
+		ts := TargetSummary{
+			Target:   name,
+			State:    status.state.String(),
+			Rollback: status.rollback.String(),
+		}
+		if len(status.errs) > 0 {
+			ts.Error = status.errs[0].Error()
+		}
+		status.mu.Unlock()
+		summary = append(summary, ts)
+	}
+	return summary
+}
@@ -0,0 +1,178 @@
+package deploy
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ki4jnq/forge"
+	"github.com/ki4jnq/forge/deploy/engine"
+	"github.com/ki4jnq/forge/deploy/history"
+)
+
+var (
+	historyCmd   *forge.Cmd
+	historyFlags = flag.NewFlagSet("deploy history", flag.ExitOnError)
+
+	historyLimit int
+	historyID    string
+)
+
+// registerHistory registers the `forge deploy history` command.
+func registerHistory() {
+	historyFlags.IntVar(
+		&historyLimit,
+		"limit",
+		20,
+		"The number of recent deploys to list, 0 lists all of them.",
+	)
+	historyFlags.StringVar(
+		&historyID,
+		"id",
+		"",
+		"Show the details of the deploy with this ID.",
+	)
+
+	historyCmd = &forge.Cmd{
+		Name:      "history",
+		Flags:     historyFlags,
+		SubRunner: runHistory,
+	}
+	forge.RegisterSub(cmd, historyCmd)
+}
+
+// runAndRecord runs the deploy and records the outcome in the deploy
+// history. Failing to record the deploy is reported, but doesn't change the
+// result of the deploy itself.
+func runAndRecord(eng *engine.Engine, env string, targets targetBlocks) error {
+	store, err := conf.History.store()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	started := time.Now()
+	entry := history.Entry{
+		ID:      started.UTC().Format("20060102-150405.000"),
+		Env:     env,
+		Targets: names,
+		Version: opts.Version,
+		User:    currentUser(),
+		Started: started,
+	}
+
+	runErr := eng.Run(opts)
+	entry.Finish(runErr, eng.Summary())
+
+	if err := store.Record(entry); err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: failed to record the deploy in the history: %v\n", err)
+	}
+	return runErr
+}
+
+// runHistory lists past deploys, or shows the details of one of them.
+func runHistory() error {
+	store, err := conf.History.store()
+	if err != nil {
+		return err
+	}
+
+	// Only filter by environment when one was asked for, otherwise show the
+	// deploys for every environment.
+	env := ""
+	historyFlags.Visit(func(f *flag.Flag) {
+		if f.Name == "env" {
+			env = historyCmd.Conf.Env
+		}
+	})
+
+	entries, err := store.List(env)
+	if err != nil {
+		return err
+	}
+
+	if historyID != "" {
+		for _, entry := range entries {
+			if entry.ID == historyID {
+				printEntry(entry)
+				return nil
+			}
+		}
+		return fmt.Errorf("No deploy with ID %q in the history", historyID)
+	}
+
+	if historyLimit > 0 && len(entries) > historyLimit {
+		entries = entries[len(entries)-historyLimit:]
+	}
+	printEntries(entries)
+	return nil
+}
+
+func printEntries(entries []history.Entry) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ID\tENV\tVERSION\tUSER\tSTARTED\tDURATION\tOUTCOME\tTARGETS")
+
+	for _, e := range entries {
+		fmt.Fprintf(
+			table,
+			"%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			e.ID,
+			e.Env,
+			e.Version,
+			e.User,
+			e.Started.Local().Format(time.RFC822),
+			e.Finished.Sub(e.Started).Round(time.Second),
+			e.Outcome,
+			strings.Join(e.Targets, ","),
+		)
+	}
+
+	table.Flush()
+}
+
+func printEntry(e history.Entry) {
+	fmt.Printf("ID:       %v\n", e.ID)
+	fmt.Printf("Env:      %v\n", e.Env)
+	fmt.Printf("Version:  %v\n", e.Version)
+	fmt.Printf("User:     %v\n", e.User)
+	fmt.Printf("Started:  %v\n", e.Started.Local().Format(time.RFC1123))
+	fmt.Printf("Finished: %v\n", e.Finished.Local().Format(time.RFC1123))
+	fmt.Printf("Outcome:  %v\n", e.Outcome)
+	if e.Error != "" {
+		fmt.Printf("Error:\n%v\n", strings.TrimRight(e.Error, "\n"))
+	}
+
+	if len(e.Results) == 0 {
+		return
+	}
+
+	fmt.Println()
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET\tSTATE\tROLLBACK")
+	for _, r := range e.Results {
+		result := r.Rollback
+		if r.Error != "" {
+			result = fmt.Sprintf("%v: %v", result, r.Error)
+		}
+		fmt.Fprintf(table, "%v\t%v\t%v\n", r.Target, r.State, result)
+	}
+	table.Flush()
+}
+
+// currentUser returns the name of the user running the deploy.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,67 @@
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// DefaultFile is where a FileStore keeps its records when no path is set in
+// the Forgefile.
+const DefaultFile = ".forge/history.jsonl"
+
+// FileStore keeps deploy records in a local file, one JSON object per line.
+type FileStore struct {
+	Path string
+}
+
+func (fs *FileStore) Record(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fs.Path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fs.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+func (fs *FileStore) List(env string) ([]Entry, error) {
+	file, err := os.Open(fs.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", fs.Path, lineNo, err)
+		}
+		if env == "" || entry.Env == env {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,74 @@
+package history
+
+import (
+	"time"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// Outcome is how a recorded deploy ended.
+type Outcome string
+
+const (
+	OutcomeSucceeded      Outcome = "succeeded"
+	OutcomeFailed         Outcome = "failed"
+	OutcomeRollbackFailed Outcome = "rollback_failed"
+)
+
+// An Entry records a single run of `forge deploy`.
+type Entry struct {
+	ID       string    `json:"id"`
+	Env      string    `json:"env"`
+	Targets  []string  `json:"targets"`
+	Version  string    `json:"version"`
+	User     string    `json:"user"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Outcome  Outcome   `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+
+	// Results holds the final state and rollback result of every target.
+	Results []engine.TargetSummary `json:"results,omitempty"`
+}
+
+// Finish fills in the end of the Entry from the error returned by
+// engine.Engine.Run and the engine's summary of its targets.
+func (e *Entry) Finish(runErr error, results []engine.TargetSummary) {
+	e.Finished = time.Now()
+	e.Results = results
+
+	switch err := runErr.(type) {
+	case nil:
+		e.Outcome = OutcomeSucceeded
+	case *engine.DeployErr:
+		e.Outcome = OutcomeFailed
+		if err.RollbackFailed() {
+			e.Outcome = OutcomeRollbackFailed
+		}
+		e.Error = err.Error()
+	default:
+		e.Outcome = OutcomeFailed
+		e.Error = err.Error()
+	}
+}
+
+// A Store keeps a record of past deploys.
+type Store interface {
+	// Record saves a finished deploy.
+	Record(Entry) error
+
+	// List returns the recorded deploys for env, oldest first. An empty env
+	// lists the deploys for every environment.
+	List(env string) ([]Entry, error)
+}
+
+// NullStore doesn't record anything.
+type NullStore struct{}
+
+func (ns NullStore) Record(Entry) error {
+	return nil
+}
+
+func (ns NullStore) List(string) ([]Entry, error) {
+	return nil, nil
+}
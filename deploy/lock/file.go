@@ -0,0 +1,75 @@
+package lock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DefaultDir is where a FileLocker keeps its lock files when no directory is
+// set in the Forgefile.
+const DefaultDir = ".forge/locks"
+
+// FileLocker locks an environment by creating a file in Dir. It only guards
+// against deploys run from the same machine, or from a shared directory.
+type FileLocker struct {
+	Dir string
+}
+
+func (fl *FileLocker) Lock(env string, holder Holder) error {
+	if err := os.MkdirAll(fl.Dir, 0755); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(fl.path(env), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return fl.heldErr(env)
+	} else if err != nil {
+		return err
+	}
+
+	_, err = file.Write(body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	// Don't leave an incomplete lock file behind to block every later deploy.
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (fl *FileLocker) Unlock(env string) error {
+	err := os.Remove(fl.path(env))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// heldErr reads the current holder of the lock for env into a HeldErr. The
+// holder creates the file before it writes to it, so a file that is empty or
+// only partly written is still held, by a holder that isn't known yet.
+func (fl *FileLocker) heldErr(env string) error {
+	body, err := ioutil.ReadFile(fl.path(env))
+	if err != nil {
+		return err
+	}
+
+	held := HeldErr{Env: env}
+	if err := json.Unmarshal(body, &held.Holder); err != nil {
+		return HeldErr{Env: env}
+	}
+	return held
+}
+
+func (fl *FileLocker) path(env string) string {
+	return filepath.Join(fl.Dir, env+".lock")
+}
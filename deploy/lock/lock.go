@@ -0,0 +1,84 @@
+package lock
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+// A Locker guards an environment so that only one deploy can run against it
+// at a time.
+type Locker interface {
+	// Lock acquires the lock for env on behalf of holder. If someone else
+	// already holds the lock, it returns a HeldErr.
+	Lock(env string, holder Holder) error
+
+	// Unlock releases the lock for env, no matter who holds it.
+	Unlock(env string) error
+}
+
+// Holder describes who holds a lock.
+type Holder struct {
+	User     string    `json:"user"`
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Version  string    `json:"version,omitempty"`
+	Acquired time.Time `json:"acquired"`
+}
+
+// NewHolder describes the current process as the holder of a lock for a
+// deploy of version.
+func NewHolder(version string) Holder {
+	holder := Holder{
+		User:     os.Getenv("USER"),
+		PID:      os.Getpid(),
+		Version:  version,
+		Acquired: time.Now(),
+	}
+	if u, err := user.Current(); err == nil {
+		holder.User = u.Username
+	}
+	holder.Host, _ = os.Hostname()
+	return holder
+}
+
+func (h Holder) String() string {
+	if h == (Holder{}) {
+		return "an unknown holder"
+	}
+
+	desc := fmt.Sprintf("%v@%v (pid %d)", h.User, h.Host, h.PID)
+	if h.Version != "" {
+		desc += fmt.Sprintf(" deploying %v", h.Version)
+	}
+	return fmt.Sprintf("%v since %v", desc, h.Acquired.Local().Format(time.RFC1123))
+}
+
+// HeldErr is returned by Locker.Lock when the lock is already held.
+type HeldErr struct {
+	Env    string
+	Holder Holder
+}
+
+func (he HeldErr) Error() string {
+	return fmt.Sprintf(
+		"The \"%v\" environment is locked by %v.\n"+
+			"If that deploy is no longer running, release the lock with:\n"+
+			"  forge deploy --env %v --force-unlock",
+		he.Env,
+		he.Holder,
+		he.Env,
+	)
+}
+
+// NullLocker never blocks a deploy.
+type NullLocker struct{}
+
+func (nl NullLocker) Lock(string, Holder) error {
+	return nil
+}
+
+func (nl NullLocker) Unlock(string) error {
+	return nil
+}
@@ -0,0 +1,272 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// The stages of a deploy that notifications can be sent for.
+const (
+	StageStarted    = "started"
+	StageSucceeded  = "succeeded"
+	StageFailed     = "failed"
+	StageRolledBack = "rolled_back"
+)
+
+// Stages lists every stage, in the order they can happen.
+var Stages = []string{StageStarted, StageSucceeded, StageFailed, StageRolledBack}
+
+// The payload presets understood by NewSink.
+const (
+	PresetGeneric = "generic"
+	PresetSlack   = "slack"
+	PresetTeams   = "teams"
+)
+
+// Templates use [[ and ]] as delimiters because the Forgefile is a template
+// itself, and would otherwise expand them before they get here.
+const (
+	leftDelim  = "[["
+	rightDelim = "]]"
+)
+
+var presets = map[string]string{
+	PresetGeneric: `[[json .]]`,
+	PresetSlack:   `{"text": [[json .Text]]}`,
+	PresetTeams: `{"@type": "MessageCard", "@context": "https://schema.org/extensions", ` +
+		`"themeColor": [[json (color .Stage)]], "summary": [[json .Text]], "text": [[json .Text]]}`,
+}
+
+var funcs = template.FuncMap{
+	"json":  toJSON,
+	"color": stageColor,
+}
+
+// Payload is the data available to a sink's template. The generic preset
+// posts it as is.
+type Payload struct {
+	Stage   string                 `json:"stage"`
+	Env     string                 `json:"env"`
+	Version string                 `json:"version,omitempty"`
+	Time    time.Time              `json:"time"`
+	Text    string                 `json:"text"`
+	Message string                 `json:"message,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+	Summary []engine.TargetSummary `json:"summary,omitempty"`
+}
+
+// A Sink is a webhook that payloads are posted to as JSON.
+type Sink struct {
+	URL string
+
+	host     string
+	stages   map[string]bool
+	template *template.Template
+}
+
+// NewSink builds a Sink that posts to url. tmpl overrides the preset when it
+// is set, and stages limits the stages that are posted, which is every stage
+// when it is empty.
+func NewSink(rawURL, preset, tmpl string, stages []string) (*Sink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid webhook url %q", rawURL)
+	}
+
+	if preset == "" {
+		preset = PresetGeneric
+	}
+	if tmpl == "" {
+		var ok bool
+		if tmpl, ok = presets[preset]; !ok {
+			return nil, fmt.Errorf("Unknown preset %q, expected \"generic\", \"slack\" or \"teams\"", preset)
+		}
+	}
+
+	t, err := template.New(u.Host).Delims(leftDelim, rightDelim).Funcs(funcs).Parse(tmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	sink := &Sink{URL: rawURL, host: u.Host, template: t}
+	if len(stages) > 0 {
+		sink.stages = make(map[string]bool, len(stages))
+	}
+	for _, stage := range stages {
+		if !isStage(stage) {
+			return nil, fmt.Errorf("Unknown event %q, expected one of %v", stage, Stages)
+		}
+		sink.stages[stage] = true
+	}
+	return sink, nil
+}
+
+func (s *Sink) wants(stage string) bool {
+	return s.stages == nil || s.stages[stage]
+}
+
+func (s *Sink) post(client *http.Client, payload Payload) error {
+	var body bytes.Buffer
+	if err := s.template.Execute(&body, payload); err != nil {
+		return err
+	}
+
+	resp, err := client.Post(s.URL, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("The webhook responded with %v", resp.Status)
+	}
+	return nil
+}
+
+// Notifier is an engine.Reporter that posts to its sinks when a deploy
+// starts, succeeds, fails or is rolled back. It ignores every other event.
+type Notifier struct {
+	Env     string
+	Version string
+	Sinks   []*Sink
+	Client  *http.Client
+
+	mu     sync.Mutex
+	failed bool
+}
+
+func New(env, version string, sinks []*Sink) *Notifier {
+	return &Notifier{
+		Env:     env,
+		Version: version,
+		Sinks:   sinks,
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Report posts the event to every sink that wants it. Notifications are sent
+// before Report returns, so that the last one isn't lost when forge exits.
+func (n *Notifier) Report(ev engine.Event) {
+	if ev.Target != "" {
+		return
+	}
+
+	stage := n.stage(ev)
+	if stage == "" {
+		return
+	}
+
+	payload := Payload{
+		Stage:   stage,
+		Env:     n.Env,
+		Version: n.Version,
+		Time:    ev.Time,
+		Message: ev.Message,
+		Error:   ev.Error,
+		Summary: ev.Summary,
+	}
+	payload.Text = n.text(payload)
+
+	for _, sink := range n.Sinks {
+		if !sink.wants(stage) {
+			continue
+		}
+		if err := sink.post(n.Client, payload); err != nil {
+			fmt.Fprintf(os.Stderr, "WARNING: failed to send a deploy notification to %v: %v\n", sink.host, err)
+		}
+	}
+}
+
+func (n *Notifier) Output() io.Writer {
+	return ioutil.Discard
+}
+
+// stage maps the event onto a stage of the deploy, or returns an empty string
+// if the event isn't one. A deploy that fails is reported as failed once,
+// whether or not it goes on to be rolled back.
+func (n *Notifier) stage(ev engine.Event) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch ev.Type {
+	case engine.EventDeployStarted:
+		return StageStarted
+	case engine.EventRollbackStarted:
+		n.failed = true
+		return StageFailed
+	case engine.EventRollbackFinished:
+		return StageRolledBack
+	case engine.EventDeployFinished:
+		if ev.Error == "" {
+			return StageSucceeded
+		}
+		if !n.failed {
+			n.failed = true
+			return StageFailed
+		}
+	}
+	return ""
+}
+
+// text is a one line description of the payload, for chat messages.
+func (n *Notifier) text(p Payload) string {
+	deploy := fmt.Sprintf("Deploy to %v", p.Env)
+	if p.Version != "" {
+		deploy = fmt.Sprintf("Deploy of %v to %v", p.Version, p.Env)
+	}
+
+	switch p.Stage {
+	case StageStarted:
+		return deploy + " started"
+	case StageSucceeded:
+		return deploy + " succeeded"
+	case StageFailed:
+		if p.Error != "" {
+			return fmt.Sprintf("%v failed: %v", deploy, p.Error)
+		}
+		return fmt.Sprintf("%v failed: %v", deploy, p.Message)
+	case StageRolledBack:
+		if p.Error != "" {
+			return fmt.Sprintf("%v was rolled back, but %v", deploy, p.Error)
+		}
+		return deploy + " was rolled back"
+	}
+	return deploy
+}
+
+func isStage(stage string) bool {
+	for _, s := range Stages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func stageColor(stage string) string {
+	switch stage {
+	case StageSucceeded:
+		return "2EB886"
+	case StageFailed:
+		return "D50200"
+	case StageRolledBack:
+		return "F2C744"
+	}
+	return "439FE0"
+}
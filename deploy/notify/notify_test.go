@@ -0,0 +1,139 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// webhook is a local server that records the bodies posted to it, and
+// responds with status.
+type webhook struct {
+	*httptest.Server
+	status int
+	bodies []map[string]interface{}
+}
+
+func newWebhook(t *testing.T, status int) *webhook {
+	wh := &webhook{status: status}
+	wh.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("The notification was posted as %q, expected application/json", ct)
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("The notification isn't valid JSON: %v\n%s", err, body)
+		}
+		wh.bodies = append(wh.bodies, payload)
+		w.WriteHeader(wh.status)
+	}))
+	t.Cleanup(wh.Close)
+	return wh
+}
+
+func newTestSink(t *testing.T, url, preset string, stages ...string) *Sink {
+	sink, err := NewSink(url, preset, "", stages)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+func TestSlackPreset(t *testing.T) {
+	wh := newWebhook(t, http.StatusOK)
+	notifier := New("production", "v1.2.0", []*Sink{newTestSink(t, wh.URL, PresetSlack)})
+
+	notifier.Report(engine.Event{Type: engine.EventDeployStarted})
+	notifier.Report(engine.Event{Type: engine.EventDeployFinished})
+
+	expected := []string{
+		"Deploy of v1.2.0 to production started",
+		"Deploy of v1.2.0 to production succeeded",
+	}
+	if len(wh.bodies) != len(expected) {
+		t.Fatalf("Got %d notifications, expected %d", len(wh.bodies), len(expected))
+	}
+	for i, body := range wh.bodies {
+		if len(body) != 1 || body["text"] != expected[i] {
+			t.Errorf("Got %v, expected {\"text\": %q}", body, expected[i])
+		}
+	}
+}
+
+func TestTeamsPreset(t *testing.T) {
+	wh := newWebhook(t, http.StatusOK)
+	notifier := New("qa", "", []*Sink{newTestSink(t, wh.URL, PresetTeams)})
+
+	notifier.Report(engine.Event{Type: engine.EventRollbackStarted, Message: "1 target(s) failed, rolling back"})
+	notifier.Report(engine.Event{Type: engine.EventRollbackFinished})
+	notifier.Report(engine.Event{Type: engine.EventDeployFinished, Error: "1 target(s) failed"})
+
+	expected := []struct{ text, color string }{
+		{"Deploy to qa failed: 1 target(s) failed, rolling back", "D50200"},
+		{"Deploy to qa was rolled back", "F2C744"},
+	}
+	if len(wh.bodies) != len(expected) {
+		t.Fatalf("Got %d notifications, expected %d", len(wh.bodies), len(expected))
+	}
+	for i, body := range wh.bodies {
+		if body["@type"] != "MessageCard" || body["themeColor"] != expected[i].color {
+			t.Errorf("Got %v, expected a MessageCard with themeColor %v", body, expected[i].color)
+		}
+		if body["text"] != expected[i].text || body["summary"] != expected[i].text {
+			t.Errorf("Got %v, expected the text and summary %q", body, expected[i].text)
+		}
+	}
+}
+
+func TestStagesFilterNotifications(t *testing.T) {
+	wh := newWebhook(t, http.StatusOK)
+	notifier := New("qa", "v1", []*Sink{newTestSink(t, wh.URL, PresetGeneric, StageSucceeded)})
+
+	notifier.Report(engine.Event{Type: engine.EventDeployStarted})
+	notifier.Report(engine.Event{Type: engine.EventTargetStarted, Target: "web"})
+	notifier.Report(engine.Event{Type: engine.EventDeployFinished})
+
+	if len(wh.bodies) != 1 || wh.bodies[0]["stage"] != StageSucceeded {
+		t.Fatalf("Got %v, expected a single %v notification", wh.bodies, StageSucceeded)
+	}
+}
+
+func TestPostFailsOnErrorStatus(t *testing.T) {
+	for _, status := range []int{http.StatusMultipleChoices, http.StatusNotFound, http.StatusInternalServerError} {
+		wh := newWebhook(t, status)
+		sink := newTestSink(t, wh.URL, PresetSlack)
+
+		if err := sink.post(http.DefaultClient, Payload{Stage: StageStarted}); err == nil {
+			t.Errorf("Posting to a webhook that responds with %d succeeded, expected an error", status)
+		}
+	}
+
+	wh := newWebhook(t, http.StatusNoContent)
+	if err := newTestSink(t, wh.URL, PresetSlack).post(http.DefaultClient, Payload{}); err != nil {
+		t.Errorf("Posting to a webhook that responds with 204 failed: %v", err)
+	}
+}
+
+func TestReportContinuesAfterAFailedSink(t *testing.T) {
+	broken := newWebhook(t, http.StatusBadGateway)
+	working := newWebhook(t, http.StatusOK)
+	notifier := New("qa", "v1", []*Sink{
+		newTestSink(t, broken.URL, PresetSlack),
+		newTestSink(t, working.URL, PresetSlack),
+	})
+
+	notifier.Report(engine.Event{Type: engine.EventDeployStarted})
+
+	if len(broken.bodies) != 1 || len(working.bodies) != 1 {
+		t.Fatalf("Got %d and %d notifications, expected one for each sink", len(broken.bodies), len(working.bodies))
+	}
+}
@@ -0,0 +1,176 @@
+package deploy
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ki4jnq/forge"
+	"github.com/ki4jnq/forge/deploy/engine"
+	"github.com/ki4jnq/forge/deploy/history"
+)
+
+var (
+	ErrPromoteEnvs = errors.New("Both --from and --to are required")
+
+	promoteCmd   *forge.Cmd
+	promoteFlags = flag.NewFlagSet("deploy promote", flag.ExitOnError)
+
+	promoteFrom string
+)
+
+// versionInspector is implemented by shippers that can tell which version is
+// deployed, such as the k8 shippers.
+type versionInspector interface {
+	DeployedVersion(ctx context.Context) (version string, healthy bool, err error)
+}
+
+// registerPromote registers the `forge deploy promote` command.
+func registerPromote() {
+	promoteFlags.StringVar(
+		&promoteFrom,
+		"from",
+		"",
+		"The environment to take the version from.",
+	)
+	addRunFlags(promoteFlags)
+
+	promoteCmd = &forge.Cmd{
+		Name:      "promote",
+		Flags:     promoteFlags,
+		SubRunner: runPromote,
+	}
+	forge.RegisterSub(cmd, promoteCmd)
+
+	// The Forgefile is read for the environment being deployed, so --to is
+	// just another name for --env.
+	promoteFlags.StringVar(
+		&promoteCmd.Conf.Env,
+		"to",
+		"",
+		"The environment to deploy the version to.",
+	)
+}
+
+// runPromote deploys the version that is running in the --from environment
+// to the --to environment.
+func runPromote() error {
+	to := promoteCmd.Conf.Env
+	if promoteFrom == "" || to == "" {
+		return ErrPromoteEnvs
+	} else if promoteFrom == to {
+		return fmt.Errorf("Can't promote the \"%v\" environment to itself", to)
+	}
+
+	source := &Config{}
+	vars := forge.ParseSection(promoteFrom, promoteCmd.Conf.Vars, "deploy", source)
+	version, err := promotedVersion(promoteFrom, source, vars)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Promoting version %q from \"%v\" to \"%v\"\n", version, promoteFrom, to)
+	opts.Version = version
+	return deployEnv(to, promoteCmd.Vars)
+}
+
+// promotedVersion finds the version that was last deployed to env. It comes
+// from the deploy history when there is one, and from the targets themselves
+// otherwise. Either way, it refuses to promote from an environment whose last
+// deploy failed, or whose targets aren't healthy or disagree on the version.
+// vars are env's variables, which its targets' options may use.
+func promotedVersion(env string, source *Config, vars forge.Vars) (string, error) {
+	store, err := source.History.store()
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := store.List(env)
+	if err != nil {
+		return "", err
+	}
+
+	version := ""
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		if last.Outcome != history.OutcomeSucceeded {
+			return "", fmt.Errorf(
+				"The last deploy to \"%v\" (%v) ended with %q, refusing to promote from it",
+				env,
+				last.ID,
+				last.Outcome,
+			)
+		}
+		version = last.Version
+	}
+
+	deployed, err := deployedVersions(env, source.Targets, vars)
+	if err != nil {
+		return "", err
+	}
+
+	for _, d := range deployed {
+		if version == "" {
+			version = d.version
+		} else if d.version != version {
+			return "", fmt.Errorf(
+				"Target \"%v\" in \"%v\" runs version %q, expected %q, refusing to promote from it",
+				d.target,
+				env,
+				d.version,
+				version,
+			)
+		}
+	}
+
+	if version == "" {
+		return "", fmt.Errorf("Couldn't find the version deployed to \"%v\"", env)
+	}
+	return version, nil
+}
+
+type deployedVersion struct {
+	target  string
+	version string
+}
+
+// deployedVersions asks every target that can tell which version it runs,
+// and fails if any of them are unhealthy. Targets without a version are left
+// out.
+func deployedVersions(env string, targets targetBlocks, vars forge.Vars) ([]deployedVersion, error) {
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx := engine.ContextForOptions(engine.Options{Env: env, Vars: vars})
+	var deployed []deployedVersion
+	for _, name := range names {
+		block := targets[name]
+		target, err := block.toTarget()
+		if err != nil {
+			return nil, fmt.Errorf("Deploy target \"%v\": %v", name, err)
+		}
+
+		inspector, ok := target.Shipper.(versionInspector)
+		if !ok {
+			continue
+		}
+
+		version, healthy, err := inspector.DeployedVersion(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Checking target \"%v\" in \"%v\": %v", name, env, err)
+		} else if !healthy {
+			return nil, fmt.Errorf("Target \"%v\" in \"%v\" isn't healthy, refusing to promote from it", name, env)
+		}
+
+		if version != "" {
+			deployed = append(deployed, deployedVersion{target: name, version: version})
+		}
+	}
+	return deployed, nil
+}
@@ -0,0 +1,92 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrNoTargets = errors.New("No deploy targets are left after applying --only and --skip")
+
+// UnknownTargetErr is returned when a target named on the command line is
+// not defined for the selected environment.
+type UnknownTargetErr struct {
+	Target string
+	Env    string
+}
+
+func (ute UnknownTargetErr) Error() string {
+	return fmt.Sprintf(
+		"Target \"%v\" is not defined in the deploy section for the \"%v\" environment",
+		ute.Target,
+		ute.Env,
+	)
+}
+
+// targetList is a flag.Value that collects target names. It accepts comma
+// separated names and can be repeated.
+type targetList []string
+
+func (tl *targetList) String() string {
+	return strings.Join(*tl, ",")
+}
+
+func (tl *targetList) Set(value string) error {
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			*tl = append(*tl, name)
+		}
+	}
+	return nil
+}
+
+func (tl targetList) contains(name string) bool {
+	for _, n := range tl {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// selectTargets returns the targets selected by the only and skip
+// lists. Every name in either list must be one of the targets. When only
+// is empty, every target not in skip is selected.
+//
+// Dependencies on targets that exist but were not selected are dropped, since
+// those targets are assumed to already be deployed.
+func (c targetBlocks) selectTargets(env string, only, skip targetList) (targetBlocks, error) {
+	for _, name := range append(append(targetList{}, only...), skip...) {
+		if _, ok := c[name]; !ok {
+			return nil, UnknownTargetErr{Target: name, Env: env}
+		}
+	}
+
+	selected := make(targetBlocks, len(c))
+	for name, block := range c {
+		if (len(only) > 0 && !only.contains(name)) || skip.contains(name) {
+			continue
+		}
+		selected[name] = block
+	}
+
+	if len(selected) == 0 {
+		return nil, ErrNoTargets
+	}
+
+	for name, block := range selected {
+		var deps []string
+		for _, dep := range block.DependsOn {
+			_, defined := c[dep]
+			_, wanted := selected[dep]
+			if defined && !wanted {
+				continue
+			}
+			deps = append(deps, dep)
+		}
+		block.DependsOn = deps
+		selected[name] = block
+	}
+
+	return selected, nil
+}
@@ -2,14 +2,21 @@ package shippers
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"sort"
+	"strings"
 
 	"github.com/ki4jnq/forge/deploy/engine"
 )
 
+// AEImageTagVar is the variable that holds the tag of the image to deploy.
+const AEImageTagVar = "ae_image_tag"
+
 type AppEngine struct {
 	tmpAppEngineConfig string
 
@@ -47,11 +54,81 @@ func (ae *AppEngine) ShipIt(ctx context.Context) chan error {
 		defer run(ae.cleanup)
 
 		run(ae.generateAppYaml)
+		run(checkpoint)
+		engine.Mutating(ctx)
 		run(ae.deploy)
 	}()
 	return ch
 }
 
+// Plan prints the app.yaml that would be generated and the gcloud command that
+// would be run with it.
+func (ae *AppEngine) Plan(ctx context.Context) (string, error) {
+	yamlBody, err := yaml.Marshal(&ae.appYaml)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"Would generate app.yaml:\n%v\nWould run: gcloud %v",
+		string(yamlBody),
+		strings.Join(ae.deployArgs(ctx), " "),
+	), nil
+}
+
+// appEngineVersion is the part of `gcloud app versions list` that Status
+// needs.
+type appEngineVersion struct {
+	ID           string  `json:"id"`
+	TrafficSplit float64 `json:"traffic_split"`
+}
+
+// Status lists the versions of the service that receive traffic, and how the
+// traffic is split between them. The version with the most traffic is
+// reported as the deployed one.
+func (ae *AppEngine) Status(ctx context.Context) (engine.Status, error) {
+	service, ok := ae.appYaml["service"].(string)
+	if !ok {
+		service = "default"
+	}
+
+	cmd := exec.CommandContext(
+		ctx,
+		"gcloud", "app", "versions", "list",
+		"--service", service,
+		"--filter", "traffic_split>0",
+		"--format", "json",
+	)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	var versions []appEngineVersion
+	if err := json.Unmarshal(out, &versions); err != nil {
+		return engine.Status{}, err
+	}
+	if len(versions) == 0 {
+		return engine.Status{Version: engine.StatusUnknown, Details: "no versions are serving"}, nil
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].TrafficSplit > versions[j].TrafficSplit
+	})
+
+	split := make([]string, len(versions))
+	for i, v := range versions {
+		split[i] = fmt.Sprintf("%v %.0f%%", v.ID, v.TrafficSplit*100)
+	}
+
+	return engine.Status{
+		Version: versions[0].ID,
+		Details: "traffic: " + strings.Join(split, ", "),
+	}, nil
+}
+
 // No need to explicitly do anything here.
 func (ae *AppEngine) Rollback(ctx context.Context) chan error {
 	ch := make(chan error)
@@ -84,20 +161,11 @@ func (ae *AppEngine) generateAppYaml(_ context.Context) error {
 }
 
 func (ae *AppEngine) deploy(ctx context.Context) error {
-	version := engine.OptionsFromContext(ctx).AppEngine.ImageTag
-
 	// NOTE: Eventually we could use exec.CommandContext so that if the
 	// context is canceled the build will be automatically halted.
-	cmdArgs := []string{"app", "deploy", "--quiet"}
-	if ae.image != "" && version != "" {
-		cmdArgs = append(cmdArgs, "--image-url", ae.image+":"+version)
-	} else if ae.image != "" {
-		cmdArgs = append(cmdArgs, "--image-url", ae.image)
-	}
-
-	cmd := exec.CommandContext(ctx, "gcloud", cmdArgs...)
+	cmd := exec.CommandContext(ctx, "gcloud", ae.deployArgs(ctx)...)
 	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
+	cmd.Stdout = engine.Output(ctx)
 	cmd.Stdin = os.Stdin
 
 	if err := cmd.Run(); err != nil {
@@ -106,6 +174,20 @@ func (ae *AppEngine) deploy(ctx context.Context) error {
 	return nil
 }
 
+// deployArgs builds the arguments passed to `gcloud` to deploy the app. The
+// image tag comes from the "ae_image_tag" variable.
+func (ae *AppEngine) deployArgs(ctx context.Context) []string {
+	version := engine.Var(ctx, AEImageTagVar)
+
+	cmdArgs := []string{"app", "deploy", "--quiet"}
+	if ae.image != "" && version != "" {
+		cmdArgs = append(cmdArgs, "--image-url", ae.image+":"+version)
+	} else if ae.image != "" {
+		cmdArgs = append(cmdArgs, "--image-url", ae.image)
+	}
+	return cmdArgs
+}
+
 func (ae *AppEngine) cleanup(_ context.Context) error {
 	if err := os.Remove(ae.tmpAppEngineConfig); err != nil {
 		return err
@@ -1,10 +1,17 @@
 package shippers
 
 import (
+	"context"
 	"errors"
 	"fmt"
 )
 
+// checkpoint returns the context's error if it has been canceled, so shippers
+// can stop between steps.
+func checkpoint(ctx context.Context) error {
+	return ctx.Err()
+}
+
 // failSafe should be used in conjunction with defer to ensure that any errors
 // encountered during shipping a service are properly handled and logged.
 func failSafe(preamble string, ch chan error) {
@@ -3,10 +3,11 @@ package shippers
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
 	"os"
 	"os/exec"
+
+	"github.com/ki4jnq/forge/deploy/engine"
 )
 
 var (
@@ -20,9 +21,8 @@ type GulpS3Shipper struct {
 func (gss *GulpS3Shipper) ShipIt(ctx context.Context) chan error {
 	ch := make(chan error)
 	go func() {
-		if err := gss.runGulp(os.Stdout, os.Stderr); err != nil {
-			fmt.Println("Failed to run command")
-			fmt.Println(err)
+		engine.Mutating(ctx)
+		if err := gss.runGulp(engine.Output(ctx), os.Stderr); err != nil {
 			ch <- err
 		}
 		close(ch)
@@ -0,0 +1,921 @@
+package k8
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge"
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+const (
+	// ownerLabel marks every object that k8-apply applies with the target's
+	// "name" option, so that the objects can be pruned once they are no
+	// longer in the manifests.
+	ownerLabel = "forge/owner"
+
+	// fieldManager is who server-side apply records as the manager of the
+	// fields in the manifests.
+	fieldManager = "forge"
+
+	// The Secret `<appliedPrefix><name>` records what was last applied: the
+	// version, and the kind and name of every object. The objects' contents,
+	// which may be Secrets, are never stored.
+	appliedPrefix     = "forge-apply-"
+	appliedVersionKey = "version"
+	appliedObjectsKey = "objects"
+)
+
+var (
+	ErrNothingApplied = errors.New("Nothing has been applied by this target yet.")
+	ErrNoManifests    = errors.New("There are no objects in the manifests.")
+)
+
+// Applier renders every manifest in the "manifests" directory as a template,
+// applies the objects with server-side apply, and prunes the objects it
+// applied before that are no longer in the manifests, once the Deployments,
+// StatefulSets and DaemonSets among them have rolled out. What it applies is
+// recorded in a Secret, so that the next deploy knows what to prune and what
+// to apply again if it has to roll back.
+type Applier struct {
+	*k8ClientProvider
+
+	// previous is the set that was applied before this deploy, or nil if
+	// there wasn't one. loaded is set once it has been read, and its objects
+	// hold what forge had applied to them before the deploy changed them.
+	previous *appliedSet
+	loaded   bool
+
+	// applied is the set this deploy applied, or started to apply.
+	applied *appliedSet
+}
+
+// appliedSet is a version and the objects that were applied for it. When it
+// is read from the record, the objects only hold their apiVersion, kind,
+// namespace and name.
+type appliedSet struct {
+	Version string
+	Objects []*unstructured.Unstructured
+}
+
+func NewApplyShipper(opts map[string]interface{}) *Applier {
+	return &Applier{
+		k8ClientProvider: &k8ClientProvider{
+			Opts: opts,
+		},
+	}
+}
+
+func (a *Applier) ShipIt(ctx context.Context) chan error {
+	ch := make(chan error)
+
+	go func() {
+		defer close(ch)
+		defer savePanics(ch)
+
+		if err := a.runApply(ctx); err != nil {
+			ch <- classifyErr(err)
+		}
+	}()
+	return ch
+}
+
+func (a *Applier) Rollback(ctx context.Context) chan error {
+	ch := make(chan error)
+
+	go func() {
+		defer close(ch)
+		defer savePanics(ch)
+
+		if err := a.rollback(ctx); err != nil {
+			ch <- err
+		}
+	}()
+	return ch
+}
+
+// Plan lists the objects that would be applied, and the objects from the
+// previously applied set that would be pruned.
+func (a *Applier) Plan(ctx context.Context) (plan string, err error) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			err = fmt.Errorf("%v", obj)
+		}
+	}()
+
+	version := engine.OptionsFromContext(ctx).Version
+	objects, err := a.prepare(ctx, version)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := a.getK8Client()
+	if err != nil {
+		return "", err
+	}
+	previous, err := a.readApplied(ctx, client)
+	if err != nil {
+		return "", err
+	}
+
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "Would apply %d object(s) for version %q:\n", len(objects), version)
+	for _, obj := range objects {
+		fmt.Fprintf(buffer, "  %v\n", describeObject(obj))
+	}
+
+	if previous != nil {
+		keep := objectKeys(objects)
+		for _, obj := range previous.Objects {
+			if !keep[objectKey(obj)] {
+				fmt.Fprintf(buffer, "Would prune %v\n", describeObject(obj))
+			}
+		}
+	}
+	return buffer.String(), nil
+}
+
+// DeployedVersion returns the version that was last applied, which is healthy
+// if every Deployment, StatefulSet and DaemonSet that was applied has rolled
+// out.
+func (a *Applier) DeployedVersion(ctx context.Context) (version string, healthy bool, err error) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			err = fmt.Errorf("%v", obj)
+		}
+	}()
+
+	client, err := a.getK8Client()
+	if err != nil {
+		return "", false, err
+	}
+
+	set, err := a.readApplied(ctx, client)
+	if err != nil {
+		return "", false, err
+	} else if set == nil {
+		return "", false, ErrNothingApplied
+	}
+
+	healthy, err = workloadsHealthy(ctx, client, set.Objects)
+	return set.Version, healthy, err
+}
+
+// Status reports the version that was last applied and how many objects it
+// had.
+func (a *Applier) Status(ctx context.Context) (status engine.Status, err error) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			err = fmt.Errorf("%v", obj)
+		}
+	}()
+
+	client, err := a.getK8Client()
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	set, err := a.readApplied(ctx, client)
+	if err != nil {
+		return engine.Status{}, err
+	} else if set == nil {
+		return engine.Status{}, ErrNothingApplied
+	}
+
+	return engine.Status{
+		Version: set.Version,
+		Details: fmt.Sprintf("%d object(s)", len(set.Objects)),
+	}, nil
+}
+
+// NeedsVersion is always true, the manifests are rendered with the version.
+func (a *Applier) NeedsVersion() bool {
+	return true
+}
+
+// runApply applies the rendered manifests, waits for the workloads among them
+// to roll out, prunes what is left of the previous set and records the new
+// one.
+func (a *Applier) runApply(ctx context.Context) error {
+	version := engine.OptionsFromContext(ctx).Version
+	objects, err := a.prepare(ctx, version)
+	if err != nil {
+		return err
+	}
+	client, err := a.getK8Client()
+	if err != nil {
+		return err
+	}
+	dyn, mapper, err := a.getDynamicClient()
+	if err != nil {
+		return err
+	}
+
+	// Once this deploy has been recorded, the record no longer holds the
+	// previous set, and once it has applied anything, the live objects no
+	// longer hold it either, so it's only read on the first attempt.
+	if !a.loaded {
+		previous, err := a.readApplied(ctx, client)
+		if err != nil {
+			return err
+		}
+		if previous != nil {
+			if previous.Objects, err = a.capture(ctx, dyn, mapper, previous.Objects); err != nil {
+				return err
+			}
+		}
+		a.previous, a.loaded = previous, true
+	}
+
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Everything the previous set and this one hold is recorded before
+	// anything is applied, so that the objects are still found and pruned
+	// later if the deploy is interrupted.
+	engine.Mutating(ctx)
+	a.applied = &appliedSet{Version: version, Objects: objects}
+	applying := &appliedSet{Version: version, Objects: objects}
+	if a.previous != nil {
+		applying.Objects = append(append([]*unstructured.Unstructured{}, objects...), a.previous.Objects...)
+	}
+	if err := a.writeApplied(ctx, client, applying); err != nil {
+		return err
+	}
+
+	if err := a.applyAll(ctx, dyn, mapper, objects); err != nil {
+		return err
+	}
+	if err := waitForWorkloads(ctx, client, objects); err != nil {
+		return err
+	}
+	if err := a.prune(ctx, dyn, mapper, objects, a.previous); err != nil {
+		return err
+	}
+	return a.writeApplied(ctx, client, a.applied)
+}
+
+// rollback applies what forge had applied to the previous set's objects
+// before the deploy again, and prunes everything else that the deploy
+// applied. If nothing was applied before the deploy, everything it applied is
+// deleted.
+func (a *Applier) rollback(ctx context.Context) error {
+	if a.applied == nil {
+		return nil
+	}
+
+	client, err := a.getK8Client()
+	if err != nil {
+		return err
+	}
+	dyn, mapper, err := a.getDynamicClient()
+	if err != nil {
+		return err
+	}
+
+	var objects []*unstructured.Unstructured
+	if a.previous != nil {
+		objects = a.previous.Objects
+	}
+	if err := a.applyAll(ctx, dyn, mapper, objects); err != nil {
+		return err
+	}
+	if err := a.prune(ctx, dyn, mapper, objects, a.applied); err != nil {
+		return err
+	}
+
+	if a.previous != nil {
+		err = a.writeApplied(ctx, client, a.previous)
+	} else {
+		err = a.deleteApplied(ctx, client)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.applied = nil
+	return nil
+}
+
+// prepare renders the manifests for version, puts namespaced objects without
+// a namespace in the "namespace" option's, and labels every object with
+// ownerLabel.
+func (a *Applier) prepare(ctx context.Context, version string) ([]*unstructured.Unstructured, error) {
+	if version == "" {
+		return nil, engine.ErrNoVersion
+	}
+
+	objects, err := a.render(ctx, version)
+	if err != nil {
+		return nil, err
+	}
+
+	_, mapper, err := a.getDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, obj := range objects {
+		mapping, err := restMapping(mapper, obj.GroupVersionKind())
+		if err != nil {
+			return nil, err
+		}
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace && obj.GetNamespace() == "" {
+			obj.SetNamespace(a.namespace())
+		}
+
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[ownerLabel] = a.mustLookup("name")
+		obj.SetLabels(labels)
+	}
+	return objects, nil
+}
+
+// render executes every .yaml, .yml and .json file under the "manifests"
+// directory as a template, with the same functions as the Forgefile, and
+// decodes the objects in them. `.Env` and `.Version` hold the environment and
+// the version being deployed.
+func (a *Applier) render(ctx context.Context, version string) ([]*unstructured.Unstructured, error) {
+	opts := engine.OptionsFromContext(ctx)
+	data := struct{ Env, Version string }{opts.Env, version}
+	funcs := forge.TemplateFuncs(forge.Vars(opts.Vars))
+
+	var objects []*unstructured.Unstructured
+	err := filepath.Walk(a.mustLookup("manifests"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml", ".json":
+		default:
+			return nil
+		}
+
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tmpl, err := template.New(filepath.Base(path)).Funcs(funcs).Parse(string(body))
+		if err != nil {
+			return err
+		}
+		buffer := &bytes.Buffer{}
+		if err := tmpl.Execute(buffer, data); err != nil {
+			return err
+		}
+
+		decoded, err := decodeManifest(path, buffer)
+		objects = append(objects, decoded...)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	} else if len(objects) == 0 {
+		return nil, ErrNoManifests
+	}
+	return objects, nil
+}
+
+// applyAll applies every object with server-side apply, taking over any
+// fields that something else manages.
+func (a *Applier) applyAll(
+	ctx context.Context,
+	dyn dynamic.Interface,
+	mapper resettableMapper,
+	objects []*unstructured.Unstructured,
+) error {
+	force := true
+	for _, obj := range applyOrder(objects) {
+		mapping, err := restMapping(mapper, obj.GroupVersionKind())
+		if err != nil {
+			return err
+		}
+
+		body, err := obj.MarshalJSON()
+		if err != nil {
+			return err
+		}
+
+		_, err = dyn.Resource(mapping.Resource).
+			Namespace(obj.GetNamespace()).
+			Patch(ctx, obj.GetName(), types.ApplyPatchType, body, metav1.PatchOptions{
+				FieldManager: fieldManager,
+				Force:        &force,
+			})
+		if err != nil {
+			return fmt.Errorf("Couldn't apply %v: %w", describeObject(obj), err)
+		}
+		engine.Progress(ctx, "Applied %v", describeObject(obj))
+	}
+	return nil
+}
+
+// prune deletes the objects labelled as owned by this target that aren't in
+// keep. It looks for them among the kinds and namespaces of the objects in
+// keep and in `other`.
+func (a *Applier) prune(
+	ctx context.Context,
+	dyn dynamic.Interface,
+	mapper resettableMapper,
+	keep []*unstructured.Unstructured,
+	other *appliedSet,
+) error {
+	candidates := append([]*unstructured.Unstructured{}, keep...)
+	if other != nil {
+		candidates = append(candidates, other.Objects...)
+	}
+
+	keepKeys := objectKeys(keep)
+	selector := fmt.Sprintf("%v=%v", ownerLabel, a.mustLookup("name"))
+	policy := metav1.DeletePropagationBackground
+	searched := make(map[string]bool)
+
+	for _, candidate := range candidates {
+		mapping, err := restMapping(mapper, candidate.GroupVersionKind())
+		if err != nil {
+			return err
+		}
+
+		resource := dyn.Resource(mapping.Resource)
+		search := mapping.Resource.String()
+		var client dynamic.ResourceInterface = resource
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			client = resource.Namespace(candidate.GetNamespace())
+			search += ", namespace=" + candidate.GetNamespace()
+		}
+		if searched[search] {
+			continue
+		}
+		searched[search] = true
+
+		owned, err := client.List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return err
+		}
+
+		for idx := range owned.Items {
+			obj := &owned.Items[idx]
+			if keepKeys[objectKey(obj)] {
+				continue
+			}
+
+			engine.Progress(ctx, "Pruning %v", describeObject(obj))
+			err := client.Delete(ctx, obj.GetName(), metav1.DeleteOptions{PropagationPolicy: &policy})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// capture reads the live objects that refs point to, with only the fields
+// that forge applied to them, so that they can be applied again as they
+// were. Objects that no longer exist are left out, since there is nothing to
+// restore. It fails if an object exists but what forge applied to it can't
+// be told.
+func (a *Applier) capture(
+	ctx context.Context,
+	dyn dynamic.Interface,
+	mapper resettableMapper,
+	refs []*unstructured.Unstructured,
+) ([]*unstructured.Unstructured, error) {
+	var objects []*unstructured.Unstructured
+	for _, ref := range refs {
+		mapping, err := restMapping(mapper, ref.GroupVersionKind())
+		if meta.IsNoMatchError(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		var client dynamic.ResourceInterface = dyn.Resource(mapping.Resource)
+		if mapping.Scope.Name() == meta.RESTScopeNameNamespace {
+			client = dyn.Resource(mapping.Resource).Namespace(ref.GetNamespace())
+		}
+		live, err := client.Get(ctx, ref.GetName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		obj, err := appliedFields(live)
+		if err != nil {
+			return nil, fmt.Errorf("Can't tell what was applied to %v, so it couldn't be rolled back: %v", describeObject(ref), err)
+		}
+		objects = append(objects, obj)
+	}
+	return objects, nil
+}
+
+// appliedFields copies the fields of obj that fieldManager set with
+// server-side apply, as recorded in its managedFields.
+func appliedFields(obj *unstructured.Unstructured) (*unstructured.Unstructured, error) {
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager != fieldManager || entry.Operation != metav1.ManagedFieldsOperationApply || entry.FieldsV1 == nil {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			return nil, err
+		}
+		content, ok := pickFields(obj.Object, fields).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("The managed fields don't describe an object")
+		}
+
+		applied := &unstructured.Unstructured{Object: content}
+		applied.SetAPIVersion(obj.GetAPIVersion())
+		applied.SetKind(obj.GetKind())
+		applied.SetNamespace(obj.GetNamespace())
+		applied.SetName(obj.GetName())
+		return applied, nil
+	}
+	return nil, fmt.Errorf("None of its fields are managed by %q", fieldManager)
+}
+
+// pickFields copies the parts of value that are listed in fields, a FieldsV1
+// set. Object fields are keyed "f:<name>", list items "k:<keys>", "v:<value>"
+// or "i:<index>", and "." stands for the value itself. A field without
+// children is copied whole.
+func pickFields(value interface{}, fields map[string]interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		picked := make(map[string]interface{})
+		for key, children := range fields {
+			if !strings.HasPrefix(key, "f:") {
+				continue
+			}
+			name := strings.TrimPrefix(key, "f:")
+			if field, ok := value[name]; ok {
+				picked[name] = pickChildren(field, children)
+			}
+		}
+		return picked
+	case []interface{}:
+		picked := make([]interface{}, 0, len(value))
+		for idx, item := range value {
+			for key, children := range fields {
+				if !listItemMatches(key, idx, item) {
+					continue
+				}
+				pickedItem := pickChildren(item, children)
+				// Keep the fields that identify the item.
+				if keys, ok := listItemKeys(key); ok {
+					if itemMap, ok := pickedItem.(map[string]interface{}); ok {
+						for name := range keys {
+							itemMap[name] = item.(map[string]interface{})[name]
+						}
+					}
+				}
+				picked = append(picked, pickedItem)
+				break
+			}
+		}
+		return picked
+	default:
+		return value
+	}
+}
+
+// pickChildren copies the children of value listed in children, or all of
+// value if none are.
+func pickChildren(value, children interface{}) interface{} {
+	set, _ := children.(map[string]interface{})
+	for key := range set {
+		if key != "." {
+			return pickFields(value, set)
+		}
+	}
+	return value
+}
+
+// listItemMatches reports whether key, from a FieldsV1 set, names the list
+// item at idx.
+func listItemMatches(key string, idx int, item interface{}) bool {
+	switch {
+	case strings.HasPrefix(key, "i:"):
+		return key == fmt.Sprintf("i:%d", idx)
+	case strings.HasPrefix(key, "v:"):
+		return sameJSON(item, json.RawMessage(strings.TrimPrefix(key, "v:")))
+	case strings.HasPrefix(key, "k:"):
+		keys, _ := listItemKeys(key)
+		itemMap, ok := item.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for name, value := range keys {
+			if !sameJSON(itemMap[name], value) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// listItemKeys decodes the fields that identify a list item from a "k:" key.
+func listItemKeys(key string) (map[string]interface{}, bool) {
+	if !strings.HasPrefix(key, "k:") {
+		return nil, false
+	}
+	var keys map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(key, "k:")), &keys); err != nil {
+		return nil, false
+	}
+	return keys, true
+}
+
+// sameJSON reports whether a and b encode to the same JSON, so that numbers
+// compare equal whatever type they were decoded as.
+func sameJSON(a, b interface{}) bool {
+	left, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	right, err := json.Marshal(b)
+	return err == nil && bytes.Equal(left, right)
+}
+
+// readApplied reads the set that was last applied from its Secret, or
+// returns nil if nothing has been applied yet.
+func (a *Applier) readApplied(ctx context.Context, client kubernetes.Interface) (*appliedSet, error) {
+	secret, err := client.CoreV1().
+		Secrets(a.namespace()).
+		Get(ctx, a.appliedName(), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var contents []map[string]interface{}
+	if err := json.Unmarshal(secret.Data[appliedObjectsKey], &contents); err != nil {
+		return nil, fmt.Errorf("Couldn't read the objects in Secret %q: %v", secret.Name, err)
+	}
+
+	set := &appliedSet{Version: string(secret.Data[appliedVersionKey])}
+	for _, content := range contents {
+		set.Objects = append(set.Objects, &unstructured.Unstructured{Object: content})
+	}
+	return set, nil
+}
+
+// writeApplied records set as the set that was last applied. Only the kind
+// and name of each object is recorded.
+func (a *Applier) writeApplied(ctx context.Context, client kubernetes.Interface, set *appliedSet) error {
+	contents := make([]map[string]interface{}, 0, len(set.Objects))
+	recorded := make(map[string]bool, len(set.Objects))
+	for _, obj := range set.Objects {
+		if key := objectKey(obj); !recorded[key] {
+			recorded[key] = true
+			contents = append(contents, objectReference(obj).Object)
+		}
+	}
+	body, err := json.Marshal(contents)
+	if err != nil {
+		return err
+	}
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   a.appliedName(),
+			Labels: map[string]string{"app": "forge"},
+		},
+		Type: v1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			appliedVersionKey: []byte(set.Version),
+			appliedObjectsKey: body,
+		},
+	}
+
+	secrets := client.CoreV1().Secrets(a.namespace())
+	_, err = secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = secrets.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	return err
+}
+
+func (a *Applier) deleteApplied(ctx context.Context, client kubernetes.Interface) error {
+	err := client.CoreV1().
+		Secrets(a.namespace()).
+		Delete(ctx, a.appliedName(), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (a *Applier) appliedName() string {
+	return appliedPrefix + a.mustLookup("name")
+}
+
+// waitForWorkloads waits for every Deployment, StatefulSet and DaemonSet
+// among objects to roll out, one after the other. The ones that only update
+// their pods once they are deleted aren't waited for.
+func waitForWorkloads(ctx context.Context, client kubernetes.Interface, objects []*unstructured.Unstructured) error {
+	apps := client.AppsV1()
+	for _, obj := range objects {
+		if obj.GroupVersionKind().Group != appsv1.GroupName {
+			continue
+		}
+
+		name, namespace := obj.GetName(), obj.GetNamespace()
+		var err error
+		switch obj.GetKind() {
+		case "Deployment":
+			var deployment *appsv1.Deployment
+			if deployment, err = apps.Deployments(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+				err = waitForDeployment(ctx, client, deployment, podSelector(deployment.Spec.Selector))
+			}
+		case "StatefulSet":
+			var set *appsv1.StatefulSet
+			if set, err = apps.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil &&
+				set.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+				err = (&statefulSet{}).waitForPods(ctx, client, set, podSelector(set.Spec.Selector))
+			}
+		case "DaemonSet":
+			var set *appsv1.DaemonSet
+			if set, err = apps.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil &&
+				set.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
+				err = (&daemonSet{}).waitForNodes(ctx, client, set, podSelector(set.Spec.Selector))
+			}
+		default:
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("%v didn't roll out: %w", describeObject(obj), err)
+		}
+		engine.Progress(ctx, "%v rolled out", describeObject(obj))
+	}
+	return nil
+}
+
+// workloadsHealthy reports whether every Deployment, StatefulSet and
+// DaemonSet among objects has rolled out.
+func workloadsHealthy(ctx context.Context, client kubernetes.Interface, objects []*unstructured.Unstructured) (bool, error) {
+	apps := client.AppsV1()
+	for _, obj := range objects {
+		if obj.GroupVersionKind().Group != appsv1.GroupName {
+			continue
+		}
+
+		name, namespace := obj.GetName(), obj.GetNamespace()
+		var healthy bool
+		var err error
+		switch obj.GetKind() {
+		case "Deployment":
+			var deployment *appsv1.Deployment
+			if deployment, err = apps.Deployments(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+				healthy = isDeploymentHealthy(deployment)
+			}
+		case "StatefulSet":
+			var set *appsv1.StatefulSet
+			if set, err = apps.StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+				healthy = isStatefulSetHealthy(set)
+			}
+		case "DaemonSet":
+			var set *appsv1.DaemonSet
+			if set, err = apps.DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{}); err == nil {
+				healthy = isDaemonSetHealthy(set)
+			}
+		default:
+			continue
+		}
+
+		if apierrors.IsNotFound(err) || (err == nil && !healthy) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// podSelector turns a workload's selector into the label selector of its
+// pods. The API server only accepts valid selectors, so the error is never
+// expected.
+func podSelector(selector *metav1.LabelSelector) string {
+	parsed, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return ""
+	}
+	return parsed.String()
+}
+
+// decodeManifest decodes every object in a rendered manifest, which may hold
+// several YAML documents.
+func decodeManifest(path string, manifest io.Reader) ([]*unstructured.Unstructured, error) {
+	decoder := yaml.NewYAMLOrJSONDecoder(manifest, 4096)
+
+	var objects []*unstructured.Unstructured
+	for {
+		var content map[string]interface{}
+		if err := decoder.Decode(&content); err == io.EOF {
+			return objects, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("Couldn't read %v: %v", path, err)
+		}
+
+		// Skip empty documents.
+		if len(content) == 0 {
+			continue
+		}
+
+		obj := &unstructured.Unstructured{Object: content}
+		if obj.GetKind() == "" || obj.GetName() == "" {
+			return nil, fmt.Errorf("Every object in %v needs a kind and a metadata.name", path)
+		}
+		objects = append(objects, obj)
+	}
+}
+
+// restMapping finds the resource for gvk. The cluster's resources are
+// rediscovered once if it isn't found, in case it was only just added, e.g.
+// by a CustomResourceDefinition.
+func restMapping(mapper resettableMapper, gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		mapper.Reset()
+		mapping, err = mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	}
+	return mapping, err
+}
+
+// applyOrder puts Namespaces and CustomResourceDefinitions first, since the
+// other objects may need them to exist.
+func applyOrder(objects []*unstructured.Unstructured) []*unstructured.Unstructured {
+	ordered := make([]*unstructured.Unstructured, 0, len(objects))
+	for _, first := range []bool{true, false} {
+		for _, obj := range objects {
+			kind := obj.GetKind()
+			if (kind == "Namespace" || kind == "CustomResourceDefinition") == first {
+				ordered = append(ordered, obj)
+			}
+		}
+	}
+	return ordered
+}
+
+// objectReference copies the apiVersion, kind, namespace and name of obj,
+// and nothing else.
+func objectReference(obj *unstructured.Unstructured) *unstructured.Unstructured {
+	ref := &unstructured.Unstructured{}
+	ref.SetAPIVersion(obj.GetAPIVersion())
+	ref.SetKind(obj.GetKind())
+	ref.SetNamespace(obj.GetNamespace())
+	ref.SetName(obj.GetName())
+	return ref
+}
+
+// objectKey identifies an object regardless of the version of its API.
+func objectKey(obj *unstructured.Unstructured) string {
+	return fmt.Sprintf("%v/%v/%v", obj.GroupVersionKind().GroupKind(), obj.GetNamespace(), obj.GetName())
+}
+
+func objectKeys(objects []*unstructured.Unstructured) map[string]bool {
+	keys := make(map[string]bool, len(objects))
+	for _, obj := range objects {
+		keys[objectKey(obj)] = true
+	}
+	return keys
+}
+
+func describeObject(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%v %v", obj.GetKind(), obj.GetName())
+	}
+	return fmt.Sprintf("%v %v/%v", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
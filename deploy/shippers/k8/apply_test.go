@@ -0,0 +1,165 @@
+package k8
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// appliedObject is the reference to an object that the record keeps.
+func appliedObject(apiVersion, kind, name string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	return obj
+}
+
+func TestWorkloadsHealthy(t *testing.T) {
+	rolledOut := testDeployment()
+	rolledOut.Status = appsv1.DeploymentStatus{UpdatedReplicas: 2, AvailableReplicas: 2}
+
+	rollingOut := testDeployment()
+	rollingOut.Status = appsv1.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 2, UnavailableReplicas: 1}
+
+	applied := []*unstructured.Unstructured{
+		appliedObject("v1", "ConfigMap", "web"),
+		appliedObject("apps/v1", "Deployment", "web"),
+	}
+
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		expected   bool
+	}{
+		{"rolled out", rolledOut, true},
+		{"rolling out", rollingOut, false},
+		{"deleted", nil, false},
+	}
+
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		if test.deployment != nil {
+			client = fake.NewSimpleClientset(test.deployment)
+		}
+
+		healthy, err := workloadsHealthy(context.Background(), client, applied)
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		} else if healthy != test.expected {
+			t.Errorf("%v: got healthy %v, expected %v", test.name, healthy, test.expected)
+		}
+	}
+}
+
+func TestWaitForWorkloadsFailsOnAStuckPod(t *testing.T) {
+	deployment := testDeployment()
+	deployment.Status = appsv1.DeploymentStatus{UpdatedReplicas: 1, AvailableReplicas: 1, UnavailableReplicas: 1}
+	pod := testPod("web-1", map[string]string{"app": "web"}, false, 3)
+	pod.Status.ContainerStatuses[0].State.Running = nil
+	pod.Status.ContainerStatuses[0].State.Waiting = &v1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}
+	client := fake.NewSimpleClientset(deployment, pod)
+
+	applied := []*unstructured.Unstructured{appliedObject("apps/v1", "Deployment", "web")}
+	if err := waitForWorkloads(context.Background(), client, applied); err == nil {
+		t.Fatal("Waiting for a Deployment with a crashing pod succeeded, expected an error")
+	}
+
+	deployment.Status = appsv1.DeploymentStatus{UpdatedReplicas: 2, AvailableReplicas: 2}
+	client = fake.NewSimpleClientset(deployment)
+	if err := waitForWorkloads(context.Background(), client, applied); err != nil {
+		t.Fatalf("Waiting for a Deployment that rolled out failed: %v", err)
+	}
+}
+
+func TestAppliedFields(t *testing.T) {
+	live := &unstructured.Unstructured{}
+	err := live.UnmarshalJSON([]byte(`{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "web",
+			"namespace": "default",
+			"uid": "1234",
+			"resourceVersion": "42",
+			"labels": {"app": "web", "forge/owner": "site", "team": "added-by-hand"},
+			"managedFields": [{
+				"manager": "forge",
+				"operation": "Apply",
+				"apiVersion": "apps/v1",
+				"fieldsType": "FieldsV1",
+				"fieldsV1": {
+					"f:metadata": {"f:labels": {"f:app": {}, "f:forge/owner": {}}},
+					"f:spec": {
+						"f:selector": {},
+						"f:template": {"f:spec": {"f:containers": {
+							"k:{\"name\":\"web\"}": {".": {}, "f:name": {}, "f:image": {}, "f:ports": {
+								"k:{\"containerPort\":80,\"protocol\":\"TCP\"}": {".": {}, "f:containerPort": {}}
+							}}
+						}}}
+					}
+				}
+			}, {
+				"manager": "kube-controller-manager",
+				"operation": "Update",
+				"apiVersion": "apps/v1",
+				"fieldsType": "FieldsV1",
+				"fieldsV1": {"f:spec": {"f:replicas": {}}}
+			}]
+		},
+		"spec": {
+			"replicas": 5,
+			"selector": {"matchLabels": {"app": "web"}},
+			"template": {"spec": {"containers": [
+				{"name": "sidecar", "image": "envoy"},
+				{"name": "web", "image": "gcr.io/acme/web:v1", "imagePullPolicy": "IfNotPresent",
+				 "ports": [{"containerPort": 80, "protocol": "TCP"}]}
+			]}}
+		},
+		"status": {"replicas": 5}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	applied, err := appliedFields(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &unstructured.Unstructured{}
+	err = expected.UnmarshalJSON([]byte(`{
+		"apiVersion": "apps/v1",
+		"kind": "Deployment",
+		"metadata": {
+			"name": "web",
+			"namespace": "default",
+			"labels": {"app": "web", "forge/owner": "site"}
+		},
+		"spec": {
+			"selector": {"matchLabels": {"app": "web"}},
+			"template": {"spec": {"containers": [
+				{"name": "web", "image": "gcr.io/acme/web:v1", "ports": [{"containerPort": 80, "protocol": "TCP"}]}
+			]}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !sameJSON(applied.Object, expected.Object) {
+		got, _ := applied.MarshalJSON()
+		want, _ := expected.MarshalJSON()
+		t.Errorf("Got the applied fields\n%s\nexpected\n%s", got, want)
+	}
+
+	live.SetManagedFields(nil)
+	if _, err := appliedFields(live); err == nil {
+		t.Error("Reading the applied fields of an object that forge never applied succeeded, expected an error")
+	}
+}
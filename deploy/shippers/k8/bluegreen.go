@@ -0,0 +1,271 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+const (
+	// colorLabel tells the blue pods from the green ones. The Service's
+	// selector includes it so that only one color gets traffic.
+	colorLabel = "color"
+	colorBlue  = "blue"
+	colorGreen = "green"
+)
+
+// blueGreen keeps two Deployments, `<name>-blue` and `<name>-green`, and a
+// Service that sends traffic to one of them. The new version is rolled out to
+// the idle color, and the Service is switched over once all of its replicas
+// are ready. Rolling back just switches the Service back.
+type blueGreen struct {
+	deployment
+
+	// service is the name of the Service that selects the live color.
+	service string
+
+	// switchedFrom is the color that was live before the Service was
+	// switched, or empty if it hasn't been.
+	switchedFrom string
+}
+
+func newBlueGreen(opts map[string]interface{}) *blueGreen {
+	service, _ := opts["service"].(string)
+	return &blueGreen{service: service}
+}
+
+func (bg *blueGreen) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	live, err := bg.liveColor(ctx, client, obj)
+	if err != nil {
+		return err
+	}
+	idle := otherColor(live)
+
+	liveDep, err := bg.getColorDeployment(ctx, client, obj, live)
+	if err != nil {
+		return err
+	}
+
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	engine.Progress(ctx, "Updating the idle %v Deployment to %v", idle, tag)
+	idleDep, err := bg.updateIdle(ctx, client, obj, idle, liveDep, image, tag)
+	if err != nil {
+		return err
+	}
+
+	watcher := newK8DeployWatcher()
+	selector := fmt.Sprintf("%v,%v=%v", obj.pods(tag), colorLabel, idle)
+	err = watcher.watchIt(ctx, client, obj.namespace, selector, desiredReplicas(idleDep), idleDep.Status.ObservedGeneration)
+	if err != nil {
+		return err
+	}
+
+	// Once the Service is switched the old color stops serving, so don't
+	// switch if the deploy was canceled while the idle color started.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	engine.Progress(ctx, "Switching Service %v from %v to %v", bg.serviceName(obj), live, idle)
+	if err := bg.switchTo(ctx, client, obj, idle); err != nil {
+		return err
+	}
+	bg.switchedFrom = live
+	return nil
+}
+
+func (bg *blueGreen) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	live, err := bg.liveColor(ctx, client, obj)
+	if err != nil {
+		return "", err
+	}
+	idle := otherColor(live)
+
+	liveDep, err := bg.getColorDeployment(ctx, client, obj, live)
+	if err != nil {
+		return "", err
+	}
+
+	idleDep, err := bg.getColorDeployment(ctx, client, obj, idle)
+	if apierrors.IsNotFound(err) {
+		idleDep = bg.idleObject(obj, idle, liveDep)
+	} else if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"%vWould switch Service %q from %v to %v once it is ready\n",
+		describeImageChanges(
+			"Deployment",
+			idleDep.Name,
+			idleDep.Labels,
+			image,
+			tag,
+			idleDep.Spec.Template.Spec.Containers,
+		),
+		bg.serviceName(obj),
+		live,
+		idle,
+	), nil
+}
+
+// rollback switches the Service back to the color that was live before the
+// deploy. The idle color is left as it is.
+func (bg *blueGreen) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	if bg.switchedFrom == "" {
+		return nil
+	}
+
+	if err := bg.switchTo(ctx, client, obj, bg.switchedFrom); err != nil {
+		return err
+	}
+	bg.switchedFrom = ""
+	return nil
+}
+
+func (bg *blueGreen) deployed(ctx context.Context, client kubernetes.Interface, obj object) (string, bool, error) {
+	deployment, err := bg.liveDeployment(ctx, client, obj)
+	if err != nil {
+		return "", false, err
+	}
+	return deployment.Labels["version"], isDeploymentHealthy(deployment), nil
+}
+
+func (bg *blueGreen) status(ctx context.Context, client kubernetes.Interface, obj object, image string) (engine.Status, error) {
+	deployment, err := bg.liveDeployment(ctx, client, obj)
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	status := deploymentStatus(deployment, image)
+	status.Details = fmt.Sprintf("serving %v", deployment.Spec.Template.Labels[colorLabel])
+	return status, nil
+}
+
+func (bg *blueGreen) serviceName(obj object) string {
+	if bg.service != "" {
+		return bg.service
+	}
+	return obj.name
+}
+
+// liveColor returns the color that the Service currently selects.
+func (bg *blueGreen) liveColor(ctx context.Context, client kubernetes.Interface, obj object) (string, error) {
+	service, err := client.CoreV1().
+		Services(obj.namespace).
+		Get(ctx, bg.serviceName(obj), metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	switch color := service.Spec.Selector[colorLabel]; color {
+	case colorBlue, colorGreen:
+		return color, nil
+	default:
+		return "", fmt.Errorf(
+			"The selector of Service %q must include %v: %v or %v: %v",
+			service.Name,
+			colorLabel,
+			colorBlue,
+			colorLabel,
+			colorGreen,
+		)
+	}
+}
+
+func (bg *blueGreen) liveDeployment(ctx context.Context, client kubernetes.Interface, obj object) (*appsv1.Deployment, error) {
+	live, err := bg.liveColor(ctx, client, obj)
+	if err != nil {
+		return nil, err
+	}
+	return bg.getColorDeployment(ctx, client, obj, live)
+}
+
+func (bg *blueGreen) getColorDeployment(ctx context.Context, client kubernetes.Interface, obj object, color string) (*appsv1.Deployment, error) {
+	return client.AppsV1().
+		Deployments(obj.namespace).
+		Get(ctx, obj.name+"-"+color, metav1.GetOptions{})
+}
+
+// updateIdle moves the idle Deployment to the new tag, with as many replicas
+// as the live one. It is created from a copy of the live Deployment if it
+// doesn't exist yet.
+func (bg *blueGreen) updateIdle(
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
+	idle string,
+	liveDep *appsv1.Deployment,
+	image string,
+	tag string,
+) (*appsv1.Deployment, error) {
+	deployments := client.AppsV1().Deployments(obj.namespace)
+
+	idleDep, err := bg.getColorDeployment(ctx, client, obj, idle)
+	create := apierrors.IsNotFound(err)
+	if create {
+		idleDep = bg.idleObject(obj, idle, liveDep)
+	} else if err != nil {
+		return nil, err
+	}
+
+	replicas := desiredReplicas(liveDep)
+	idleDep.Spec.Replicas = &replicas
+	bg.updateDeploymentObject(idleDep, image, tag)
+
+	if create {
+		return deployments.Create(ctx, idleDep, metav1.CreateOptions{})
+	}
+	return deployments.Update(ctx, idleDep, metav1.UpdateOptions{})
+}
+
+// idleObject builds the idle Deployment from a copy of the live one.
+func (bg *blueGreen) idleObject(obj object, idle string, liveDep *appsv1.Deployment) *appsv1.Deployment {
+	idleDep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      obj.name + "-" + idle,
+			Namespace: liveDep.Namespace,
+			Labels:    copyLabels(liveDep.Labels),
+		},
+		Spec: *liveDep.Spec.DeepCopy(),
+	}
+
+	if idleDep.Spec.Selector == nil {
+		idleDep.Spec.Selector = &metav1.LabelSelector{MatchLabels: copyLabels(liveDep.Spec.Template.Labels)}
+	}
+	if idleDep.Spec.Selector.MatchLabels == nil {
+		idleDep.Spec.Selector.MatchLabels = make(map[string]string)
+	}
+	idleDep.Spec.Selector.MatchLabels[colorLabel] = idle
+
+	idleDep.Spec.Template.Labels = copyLabels(liveDep.Spec.Template.Labels)
+	idleDep.Spec.Template.Labels[colorLabel] = idle
+	return idleDep
+}
+
+// switchTo points the Service at the color.
+func (bg *blueGreen) switchTo(ctx context.Context, client kubernetes.Interface, obj object, color string) error {
+	patch := fmt.Sprintf(`{"spec":{"selector":{%q:%q}}}`, colorLabel, color)
+	_, err := client.CoreV1().
+		Services(obj.namespace).
+		Patch(ctx, bg.serviceName(obj), types.StrategicMergePatchType, []byte(patch), metav1.PatchOptions{})
+	return err
+}
+
+func otherColor(color string) string {
+	if color == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
@@ -0,0 +1,224 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+const (
+	canarySuffix = "-canary"
+
+	// The canary Deployment and its pods are labelled with track=canary so
+	// that they can be told apart from the main Deployment and its pods,
+	// which share all of their other labels.
+	trackLabel  = "track"
+	trackCanary = "canary"
+
+	defaultCanaryReplicas = 1
+	defaultBakeTime       = 5 * time.Minute
+)
+
+// canary runs the new tag in a separate `<name>-canary` Deployment first.
+// Its pods keep the app's labels, so they get a share of the app's traffic.
+// Once the canary has baked without problems the main Deployment is rolled
+// forward. The canary is removed either way.
+type canary struct {
+	deployment
+
+	replicas    int32
+	bakeTime    time.Duration
+	maxRestarts int32
+
+	// canaryUp is set while the canary Deployment may exist.
+	canaryUp bool
+}
+
+func newCanary(opts map[string]interface{}) (*canary, error) {
+	replicas, err := intOpt(opts, "canary_replicas", defaultCanaryReplicas)
+	if err != nil {
+		return nil, err
+	} else if replicas < 1 {
+		return nil, fmt.Errorf("Invalid canary_replicas %d, it must be at least 1", replicas)
+	}
+
+	bakeTime, err := durationOpt(opts, "bake_time", defaultBakeTime)
+	if err != nil {
+		return nil, err
+	}
+
+	maxRestarts, err := intOpt(opts, "max_restarts", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &canary{
+		replicas:    replicas,
+		bakeTime:    bakeTime,
+		maxRestarts: maxRestarts,
+	}, nil
+}
+
+func (c *canary) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	main, err := c.getCurrentDeployment(ctx, client, obj)
+	if err != nil {
+		return err
+	}
+
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	canaryName := obj.name + canarySuffix
+	selector := fmt.Sprintf("%v,%v=%v", obj.pods(tag), trackLabel, trackCanary)
+	watcher := newK8DeployWatcher()
+
+	engine.Progress(ctx, "Starting %d canary replica(s) in %v", c.replicas, canaryName)
+	c.canaryUp = true
+	if err := c.startCanary(ctx, client, main, canaryName, image, tag); err != nil {
+		return c.abort(ctx, client, obj, err)
+	}
+	if err := watcher.watchIt(ctx, client, obj.namespace, selector, c.replicas, 0); err != nil {
+		return c.abort(ctx, client, obj, err)
+	}
+
+	engine.Progress(ctx, "Baking the canary for %v", c.bakeTime)
+	if err := watcher.bake(ctx, client, obj.namespace, selector, c.bakeTime, c.maxRestarts); err != nil {
+		return c.abort(ctx, client, obj, fmt.Errorf("The canary failed: %v", err))
+	}
+
+	// The canary is left running until the main Deployment has rolled
+	// forward, so the new version never stops serving.
+	engine.Progress(ctx, "The canary is healthy, updating %v", main.Name)
+	stable := fmt.Sprintf("%v,%v!=%v", obj.pods(tag), trackLabel, trackCanary)
+	if err := c.rollForward(ctx, client, main, image, tag, stable); err != nil {
+		return err
+	}
+
+	if err := c.removeCanary(ctx, client, obj); err != nil {
+		engine.Warn(ctx, "Couldn't remove the canary %v: %v", canaryName, err)
+	}
+	return nil
+}
+
+func (c *canary) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	plan, err := c.deployment.plan(ctx, client, obj, image, tag)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"Would run %d replica(s) of %v in Deployment %q and bake them for %v (%d restart(s) allowed), then:\n%v",
+		c.replicas,
+		tag,
+		obj.name+canarySuffix,
+		c.bakeTime,
+		c.maxRestarts,
+		plan,
+	), nil
+}
+
+// rollback removes the canary if it is still around, then rolls the main
+// Deployment back if it had been updated.
+func (c *canary) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	if c.canaryUp {
+		if err := c.removeCanary(ctx, client, obj); err != nil {
+			return err
+		}
+	}
+	return c.deployment.rollback(ctx, client, obj)
+}
+
+// abort tears the canary down after it failed, and returns err.
+func (c *canary) abort(ctx context.Context, client kubernetes.Interface, obj object, err error) error {
+	engine.Progress(ctx, "Removing the canary %v", obj.name+canarySuffix)
+	if rmErr := c.removeCanary(ctx, client, obj); rmErr != nil {
+		engine.Warn(ctx, "Couldn't remove the canary %v: %v", obj.name+canarySuffix, rmErr)
+	}
+	return err
+}
+
+// startCanary creates the canary Deployment, or updates it if one was left
+// behind by an earlier deploy.
+func (c *canary) startCanary(
+	ctx context.Context,
+	client kubernetes.Interface,
+	main *appsv1.Deployment,
+	canaryName string,
+	image string,
+	tag string,
+) error {
+	deployments := client.AppsV1().Deployments(main.Namespace)
+	desired := c.canaryObject(main, canaryName, image, tag)
+
+	existing, err := deployments.Get(ctx, canaryName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = deployments.Create(ctx, desired, metav1.CreateOptions{})
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	// A Deployment's selector can't be changed, so leave it alone.
+	existing.Labels = desired.Labels
+	existing.Spec.Replicas = desired.Spec.Replicas
+	existing.Spec.Template = desired.Spec.Template
+	_, err = deployments.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// canaryObject builds the canary Deployment from a copy of the main one.
+func (c *canary) canaryObject(main *appsv1.Deployment, canaryName, image, tag string) *appsv1.Deployment {
+	obj := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      canaryName,
+			Namespace: main.Namespace,
+			Labels:    copyLabels(main.Labels),
+		},
+		Spec: *main.Spec.DeepCopy(),
+	}
+
+	// Label the Deployment itself as the canary, so that it is never mistaken
+	// for the main Deployment.
+	obj.Labels[trackLabel] = trackCanary
+	obj.Labels["version"] = tag
+
+	replicas := c.replicas
+	obj.Spec.Replicas = &replicas
+
+	if obj.Spec.Selector == nil {
+		obj.Spec.Selector = &metav1.LabelSelector{MatchLabels: copyLabels(main.Spec.Template.Labels)}
+	}
+	if obj.Spec.Selector.MatchLabels == nil {
+		obj.Spec.Selector.MatchLabels = make(map[string]string)
+	}
+	obj.Spec.Selector.MatchLabels[trackLabel] = trackCanary
+
+	obj.Spec.Template.Labels = copyLabels(main.Spec.Template.Labels)
+	obj.Spec.Template.Labels[trackLabel] = trackCanary
+	obj.Spec.Template.Labels["version"] = tag
+	obj.Spec.Template.Spec.Containers = updateContainerImages(image, tag, obj.Spec.Template.Spec.Containers)
+	return obj
+}
+
+// removeCanary deletes obj's canary Deployment along with its pods.
+func (c *canary) removeCanary(ctx context.Context, client kubernetes.Interface, obj object) error {
+	policy := metav1.DeletePropagationBackground
+	err := client.AppsV1().
+		Deployments(obj.namespace).
+		Delete(ctx, obj.name+canarySuffix, metav1.DeleteOptions{PropagationPolicy: &policy})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	c.canaryUp = false
+	return nil
+}
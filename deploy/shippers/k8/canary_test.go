@@ -0,0 +1,321 @@
+package k8
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var testObject = object{name: "web", namespace: "default", selector: "app=web"}
+
+// testDeployment is the main Deployment of testObject, running v1 with two
+// replicas.
+func testDeployment() *appsv1.Deployment {
+	replicas := int32(2)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "web", "version": "v1"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web", "version": "v1"}},
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "web", Image: "gcr.io/acme/web:v1"}},
+				},
+			},
+		},
+	}
+}
+
+func testPod(name string, labels map[string]string, ready bool, restarts int32) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels},
+		Status: v1.PodStatus{
+			Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}},
+			ContainerStatuses: []v1.ContainerStatus{{
+				RestartCount: restarts,
+				State:        v1.ContainerState{Running: &v1.ContainerStateRunning{}},
+			}},
+		},
+	}
+}
+
+func canaryPodLabels(version string) map[string]string {
+	return map[string]string{"app": "web", "version": version, trackLabel: trackCanary}
+}
+
+// podWatch is a pod watch started by the code under test, which the test
+// sends events to.
+type podWatch struct {
+	selector string
+	*watch.FakeWatcher
+}
+
+// watchPods hands the test every pod watch started on client.
+func watchPods(client *fake.Clientset) chan podWatch {
+	watches := make(chan podWatch, 4)
+	client.PrependWatchReactor("pods", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		watcher := watch.NewFake()
+		selector := action.(k8stesting.WatchAction).GetWatchRestrictions().Labels.String()
+		watches <- podWatch{selector: selector, FakeWatcher: watcher}
+		return true, watcher, nil
+	})
+	return watches
+}
+
+// startPods creates the pods and sends them to the next pod watch, which
+// must select them.
+func startPods(t *testing.T, client kubernetes.Interface, watches chan podWatch, selector string, pods ...*v1.Pod) {
+	t.Helper()
+
+	var w podWatch
+	select {
+	case w = <-watches:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for a watch on %q", selector)
+	}
+	if w.selector != selector {
+		t.Fatalf("Watched pods matching %q, expected %q", w.selector, selector)
+	}
+
+	for _, pod := range pods {
+		if _, err := client.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		w.Add(pod)
+	}
+}
+
+func getDeployment(t *testing.T, client kubernetes.Interface, name string) *appsv1.Deployment {
+	t.Helper()
+	deployment, err := client.AppsV1().Deployments("default").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deployment
+}
+
+func assertNoCanary(t *testing.T, client kubernetes.Interface) {
+	t.Helper()
+	_, err := client.AppsV1().Deployments("default").Get(context.Background(), "web-canary", metav1.GetOptions{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("The canary Deployment is still around: %v", err)
+	}
+}
+
+func shortBakes(t *testing.T) {
+	interval := bakeCheckInterval
+	bakeCheckInterval = time.Millisecond
+	t.Cleanup(func() { bakeCheckInterval = interval })
+}
+
+func TestCanaryPromotesAHealthyCanary(t *testing.T) {
+	shortBakes(t)
+	client := fake.NewSimpleClientset(testDeployment())
+	watches := watchPods(client)
+	c := &canary{replicas: 1, bakeTime: 10 * time.Millisecond}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.update(context.Background(), client, testObject, "gcr.io/acme/web", "v2")
+	}()
+
+	startPods(t, client, watches, "app=web,track=canary,version=v2",
+		testPod("web-canary-1", canaryPodLabels("v2"), true, 0),
+	)
+
+	canaryDeployment := getDeployment(t, client, "web-canary")
+	if canaryDeployment.Labels[trackLabel] != trackCanary || canaryDeployment.Spec.Template.Labels[trackLabel] != trackCanary {
+		t.Errorf("The canary Deployment and its pods aren't labelled %v=%v", trackLabel, trackCanary)
+	}
+	if canaryDeployment.Spec.Selector.MatchLabels[trackLabel] != trackCanary {
+		t.Errorf("The canary Deployment's selector %v doesn't select by track", canaryDeployment.Spec.Selector)
+	}
+
+	startPods(t, client, watches, "app=web,track!=canary,version=v2",
+		testPod("web-1", map[string]string{"app": "web", "version": "v2"}, true, 0),
+		testPod("web-2", map[string]string{"app": "web", "version": "v2"}, true, 0),
+	)
+
+	if err := <-errs; err != nil {
+		t.Fatalf("The canary deploy failed: %v", err)
+	}
+
+	main := getDeployment(t, client, "web")
+	if image := main.Spec.Template.Spec.Containers[0].Image; image != "gcr.io/acme/web:v2" {
+		t.Errorf("The main Deployment runs %v, expected gcr.io/acme/web:v2", image)
+	}
+	if _, ok := main.Spec.Template.Labels[trackLabel]; ok {
+		t.Errorf("The main Deployment's pods were labelled with %v", trackLabel)
+	}
+	assertNoCanary(t, client)
+}
+
+func TestCanaryAbortsWhenTheCanaryRestarts(t *testing.T) {
+	shortBakes(t)
+	client := fake.NewSimpleClientset(testDeployment())
+	watches := watchPods(client)
+	c := &canary{replicas: 1, bakeTime: time.Minute, maxRestarts: 1}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.update(context.Background(), client, testObject, "gcr.io/acme/web", "v2")
+	}()
+
+	startPods(t, client, watches, "app=web,track=canary,version=v2",
+		testPod("web-canary-1", canaryPodLabels("v2"), true, 2),
+	)
+
+	err := <-errs
+	if err == nil || !strings.Contains(err.Error(), "The canary failed") {
+		t.Fatalf("The deploy returned %v, expected the canary to fail", err)
+	}
+
+	main := getDeployment(t, client, "web")
+	if image := main.Spec.Template.Spec.Containers[0].Image; image != "gcr.io/acme/web:v1" {
+		t.Errorf("The main Deployment was updated to %v", image)
+	}
+	assertNoCanary(t, client)
+
+	// Nothing is left for a rollback to do.
+	if err := c.rollback(context.Background(), client, testObject); err != nil {
+		t.Errorf("The rollback failed: %v", err)
+	}
+}
+
+func TestCanaryRollbackRemovesTheCanary(t *testing.T) {
+	main := testDeployment()
+	c := &canary{replicas: 1, canaryUp: true}
+	client := fake.NewSimpleClientset(main, c.canaryObject(main, "web-canary", "gcr.io/acme/web", "v2"))
+
+	if err := c.rollback(context.Background(), client, testObject); err != nil {
+		t.Fatalf("The rollback failed: %v", err)
+	}
+
+	assertNoCanary(t, client)
+	getDeployment(t, client, "web")
+	if c.canaryUp {
+		t.Error("The canary is still marked as up")
+	}
+}
+
+func TestAbortReturnsTheFailure(t *testing.T) {
+	main := testDeployment()
+	c := &canary{replicas: 1, canaryUp: true}
+	client := fake.NewSimpleClientset(main, c.canaryObject(main, "web-canary", "gcr.io/acme/web", "v2"))
+
+	failure := ErrPodsFailedToStart
+	if err := c.abort(context.Background(), client, testObject, failure); err != failure {
+		t.Errorf("abort returned %v, expected %v", err, failure)
+	}
+	assertNoCanary(t, client)
+
+	// Aborting again, when there's no canary left, is fine.
+	if err := c.abort(context.Background(), client, testObject, failure); err != failure {
+		t.Errorf("abort returned %v, expected %v", err, failure)
+	}
+}
+
+func TestCanaryObjectKeepsTheMainDeploymentApart(t *testing.T) {
+	main := testDeployment()
+	c := &canary{replicas: 1}
+	canaryDeployment := c.canaryObject(main, "web-canary", "gcr.io/acme/web", "v2")
+
+	if _, ok := main.Labels[trackLabel]; ok {
+		t.Error("Building the canary labelled the main Deployment")
+	}
+	if _, ok := main.Spec.Template.Labels[trackLabel]; ok {
+		t.Error("Building the canary labelled the main Deployment's pods")
+	}
+	if *canaryDeployment.Spec.Replicas != 1 {
+		t.Errorf("The canary has %d replicas, expected 1", *canaryDeployment.Spec.Replicas)
+	}
+
+	client := fake.NewSimpleClientset(main, canaryDeployment)
+	current, err := (&deployment{}).getCurrentDeployment(context.Background(), client, testObject)
+	if err != nil {
+		t.Fatal(err)
+	} else if current.Name != "web" {
+		t.Errorf("Found the %v Deployment, expected the main one", current.Name)
+	}
+}
+
+func TestCheckHealth(t *testing.T) {
+	selector := "app=web,track=canary,version=v2"
+	mainPod := testPod("web-1", map[string]string{"app": "web", "version": "v2"}, false, 5)
+
+	tests := []struct {
+		name    string
+		pods    []*v1.Pod
+		healthy bool
+	}{
+		{"no pods", nil, false},
+		{"ready", []*v1.Pod{testPod("c-1", canaryPodLabels("v2"), true, 0)}, true},
+		{"not ready", []*v1.Pod{testPod("c-1", canaryPodLabels("v2"), false, 0)}, false},
+		{"restarted", []*v1.Pod{testPod("c-1", canaryPodLabels("v2"), true, 2)}, false},
+		{"restarted within limits", []*v1.Pod{testPod("c-1", canaryPodLabels("v2"), true, 1)}, true},
+		{"old canary", []*v1.Pod{testPod("c-1", canaryPodLabels("v1"), true, 0)}, false},
+		{"main pods ignored", []*v1.Pod{mainPod, testPod("c-1", canaryPodLabels("v2"), true, 0)}, true},
+	}
+
+	for _, test := range tests {
+		client := fake.NewSimpleClientset()
+		for _, pod := range test.pods {
+			client.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{})
+		}
+
+		err := newK8DeployWatcher().checkHealth(context.Background(), client, "default", selector, 1)
+		if healthy := err == nil; healthy != test.healthy {
+			t.Errorf("%v: checkHealth returned %v, expected healthy to be %v", test.name, err, test.healthy)
+		}
+	}
+}
+
+func TestBakeStopsWhenCanceled(t *testing.T) {
+	shortBakes(t)
+	client := fake.NewSimpleClientset(testPod("c-1", canaryPodLabels("v2"), true, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := newK8DeployWatcher().bake(ctx, client, "default", "app=web,track=canary", time.Minute, 0)
+	if err != context.DeadlineExceeded {
+		t.Errorf("bake returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBakeFailsWhenAPodStopsBeingReady(t *testing.T) {
+	shortBakes(t)
+	pod := testPod("c-1", canaryPodLabels("v2"), true, 0)
+	client := fake.NewSimpleClientset(pod)
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		pod.Status.Conditions[0].Status = v1.ConditionFalse
+		client.CoreV1().Pods("default").UpdateStatus(context.Background(), pod, metav1.UpdateOptions{})
+	}()
+
+	err := newK8DeployWatcher().bake(context.Background(), client, "default", "app=web,track=canary", time.Minute, 0)
+	if err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Errorf("bake returned %v, expected the pod not to be ready", err)
+	}
+}
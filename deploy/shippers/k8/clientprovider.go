@@ -3,9 +3,25 @@ package k8
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/tools/clientcmd/api"
+	"k8s.io/client-go/util/homedir"
+
+	// Register the auth-provider plugins that kubeconfigs commonly use. exec
+	// plugins are built into client-go.
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/oidc"
 )
 
 const (
@@ -14,33 +30,134 @@ const (
 	currentK8Context = "theonlyonewecareabout"
 	currentK8User    = "justme"
 	currentK8Cluster = "overthere"
-	// Unlike the previous consts, k8Namespace is non-arbitrary.
-	k8Namespace = "default"
+	// Unlike the previous consts, defaultNamespace is non-arbitrary. It is
+	// used when the "namespace" option isn't set, and the connection doesn't
+	// name a namespace either.
+	defaultNamespace = "default"
 )
 
+// serviceAccountNamespaceFile holds the namespace of the pod forge runs in,
+// when it runs on the cluster.
+var serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 var (
 	ErrMissingConfig = errors.New("Missing some expected configuration values.")
 	ErrConfigInvalid = errors.New("A configuration option is invalid.")
 )
 
 type k8ClientProvider struct {
-	client *kubernetes.Clientset
-	Opts   map[string]interface{}
+	client  kubernetes.Interface
+	dynamic dynamic.Interface
+	mapper  resettableMapper
+	Opts    map[string]interface{}
+
+	// connectionNs caches the namespace named by the connection, see
+	// namespace.
+	connectionNs string
 }
 
-// getK8Client returns a Kubernetes Clientset configured to talk to a
+// resettableMapper is a RESTMapper that caches what it discovers from the
+// cluster, until it is reset.
+type resettableMapper interface {
+	meta.RESTMapper
+	Reset()
+}
+
+// getK8Client returns a Kubernetes client configured to talk to a
 // particular K8 cluster.
-func (kcp *k8ClientProvider) getK8Client() (*kubernetes.Clientset, error) {
+func (kcp *k8ClientProvider) getK8Client() (kubernetes.Interface, error) {
 	if kcp.client != nil {
 		return kcp.client, nil
 	}
 
-	config, err := clientcmd.BuildConfigFromKubeconfigGetter("", kcp.configGetter)
+	config, err := kcp.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, err
 	}
-	kcp.client, err = kubernetes.NewForConfig(config)
-	return kcp.client, err
+	kcp.client = client
+	return client, nil
+}
+
+// getDynamicClient returns a client that can work with any kind of object on
+// the cluster, along with a RESTMapper to find the resource for each kind.
+func (kcp *k8ClientProvider) getDynamicClient() (dynamic.Interface, resettableMapper, error) {
+	if kcp.dynamic != nil {
+		return kcp.dynamic, kcp.mapper, nil
+	}
+
+	config, err := kcp.restConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	kcp.dynamic = client
+	kcp.mapper = restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+	return kcp.dynamic, kcp.mapper, nil
+}
+
+// restConfig picks how to connect to the cluster. "inCluster" uses the
+// service account of the pod forge runs in, "kubeconfig" and "context" load a
+// kubeconfig file, and otherwise the config is built from the inline options.
+func (kcp *k8ClientProvider) restConfig() (*rest.Config, error) {
+	inCluster, ok := kcp.Opts["inCluster"]
+	if ok {
+		if enabled, isBool := inCluster.(bool); !isBool {
+			return nil, ErrConfigInvalid
+		} else if enabled {
+			return rest.InClusterConfig()
+		}
+	}
+
+	if kcp.usesKubeconfig() {
+		config, err := kcp.loadKubeconfig()
+		if err != nil {
+			return nil, err
+		}
+		return config.ClientConfig()
+	}
+
+	return clientcmd.BuildConfigFromKubeconfigGetter("", kcp.configGetter)
+}
+
+// usesKubeconfig reports whether the "kubeconfig" or "context" options are
+// set, so that the connection comes from a kubeconfig.
+func (kcp *k8ClientProvider) usesKubeconfig() bool {
+	_, hasPath := kcp.Opts["kubeconfig"]
+	_, hasContext := kcp.Opts["context"]
+	return hasPath || hasContext
+}
+
+// loadKubeconfig loads the "kubeconfig" file, or the default kubeconfig
+// ($KUBECONFIG or ~/.kube/config) if it isn't set, and uses its "context", or
+// its current context if that isn't set.
+func (kcp *k8ClientProvider) loadKubeconfig() (clientcmd.ClientConfig, error) {
+	var path, contextName string
+	if err := kcp.readOptionalConfig("kubeconfig", &path); err != nil {
+		return nil, err
+	}
+	if err := kcp.readOptionalConfig("context", &contextName); err != nil {
+		return nil, err
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	if path != "" {
+		rules.ExplicitPath = expandHome(path)
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: contextName}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides), nil
 }
 
 // configGetter is a function passed to the K8 client lib and returns a K8
@@ -92,7 +209,7 @@ loop:
 		}
 	}
 
-	context.Namespace = "default"
+	context.Namespace = kcp.namespace()
 	context.AuthInfo = currentK8User
 	context.Cluster = currentK8Cluster
 
@@ -105,6 +222,61 @@ loop:
 	return kubeConfig, nil
 }
 
+// TODO: The configuration should be verified at an early step, as opposed to
+// paniking if things aren't exactly what we expect.
+func (kcp *k8ClientProvider) mustLookup(key string) string {
+	name, ok := kcp.Opts[key].(string)
+	if !ok {
+		panic(ConfigErr{key})
+	}
+	return name
+}
+
+// namespace returns the "namespace" option. If it isn't set, the namespace
+// comes from the connection: the kubeconfig context's namespace, or the
+// namespace of the pod's service account for "inCluster". Otherwise it is the
+// default namespace.
+func (kcp *k8ClientProvider) namespace() string {
+	if ns, ok := kcp.Opts["namespace"].(string); ok && ns != "" {
+		return ns
+	}
+
+	if kcp.connectionNs == "" {
+		kcp.connectionNs = kcp.connectionNamespace()
+	}
+	return kcp.connectionNs
+}
+
+// connectionNamespace finds the namespace named by the connection options.
+// Connecting will fail anyway if they are broken, so any error here just
+// means the default namespace.
+func (kcp *k8ClientProvider) connectionNamespace() string {
+	if inCluster, _ := kcp.Opts["inCluster"].(bool); inCluster {
+		body, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+		if ns := strings.TrimSpace(string(body)); err == nil && ns != "" {
+			return ns
+		}
+	} else if kcp.usesKubeconfig() {
+		config, err := kcp.loadKubeconfig()
+		if err != nil {
+			return defaultNamespace
+		}
+		if ns, _, err := config.Namespace(); err == nil && ns != "" {
+			return ns
+		}
+	}
+	return defaultNamespace
+}
+
+// readOptionalConfig reads the option `name` into target, leaving target
+// alone if the option isn't set.
+func (kcp *k8ClientProvider) readOptionalConfig(name string, target *string) error {
+	if err := kcp.readConfigInto([]string{name}, target); err != ErrMissingConfig {
+		return err
+	}
+	return nil
+}
+
 // readConfigInto reads options from the Forge config into variables passed
 // in the `targets` varargs. Care should be taken to ensure that len(optNames)
 // is <= len(targets).
@@ -133,3 +305,11 @@ func (kcp *k8ClientProvider) readConfigInto(optNames []string, targets ...interf
 	}
 	return nil
 }
+
+// expandHome replaces a leading "~" in path with the user's home directory.
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(homedir.HomeDir(), path[1:])
+	}
+	return path
+}
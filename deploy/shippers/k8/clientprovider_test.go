@@ -0,0 +1,66 @@
+package k8
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: ci
+clusters:
+- name: cluster
+  cluster:
+    server: https://127.0.0.1:6443
+users:
+- name: user
+  user:
+    token: abc
+contexts:
+- name: ci
+  context:
+    cluster: cluster
+    user: user
+    namespace: team-ci
+- name: bare
+  context:
+    cluster: cluster
+    user: user
+`
+
+func TestNamespace(t *testing.T) {
+	dir := t.TempDir()
+	kubeconfig := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(kubeconfig, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	path := serviceAccountNamespaceFile
+	serviceAccountNamespaceFile = filepath.Join(dir, "namespace")
+	defer func() { serviceAccountNamespaceFile = path }()
+	if err := ioutil.WriteFile(serviceAccountNamespaceFile, []byte("team-pods\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     map[string]interface{}
+		expected string
+	}{
+		{"inline", map[string]interface{}{"server": "https://127.0.0.1"}, defaultNamespace},
+		{"option", map[string]interface{}{"kubeconfig": kubeconfig, "namespace": "web"}, "web"},
+		{"current context", map[string]interface{}{"kubeconfig": kubeconfig}, "team-ci"},
+		{"context without namespace", map[string]interface{}{"kubeconfig": kubeconfig, "context": "bare"}, defaultNamespace},
+		{"missing kubeconfig", map[string]interface{}{"kubeconfig": filepath.Join(dir, "missing")}, defaultNamespace},
+		{"in cluster", map[string]interface{}{"inCluster": true}, "team-pods"},
+		{"in cluster with option", map[string]interface{}{"inCluster": true, "namespace": "web"}, "web"},
+	}
+
+	for _, test := range tests {
+		kcp := &k8ClientProvider{Opts: test.opts}
+		if ns := kcp.namespace(); ns != test.expected {
+			t.Errorf("%v: got namespace %q, expected %q", test.name, ns, test.expected)
+		}
+	}
+}
@@ -1,49 +1,200 @@
 package k8
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
-	"k8s.io/api/batch/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
 )
 
-type cronjob struct{}
+// previousAnnotation holds the images and version labels a CronJob had
+// before forge last updated it. Rollbacks restore them from there, and if
+// forge dies before it can roll back, they can still be restored by hand.
+const previousAnnotation = "forge/previous"
+
+type cronjob struct {
+	// The name of the CronJob once it has been updated, so that it can be
+	// rolled back. Empty if nothing needs a rollback.
+	updated string
+
+	// deploy identifies the deploy in the snapshots it records, once it has
+	// started updating the CronJob.
+	deploy string
+}
+
+// cronJobSnapshot is what a rollback restores on a CronJob.
+type cronJobSnapshot struct {
+	// Deploy identifies the deploy that recorded the snapshot.
+	Deploy string `json:"deploy"`
 
-func (cj *cronjob) update(client *kubernetes.Clientset, name, image, tag string) error {
-	job, err := cj.getCurrentJob(client, name)
+	Version         string `json:"version"`
+	TemplateVersion string `json:"templateVersion"`
+
+	// Images maps each container's name to its image.
+	Images map[string]string `json:"images"`
+}
+
+func (cj *cronjob) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	job, err := cj.getCurrentJob(ctx, client, obj)
 	if err != nil {
 		return err
 	}
 
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if cj.deploy == "" {
+		cj.deploy = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	if err := cj.recordPrevious(job); err != nil {
+		return err
+	}
 	cj.updateObject(job, image, tag)
 
-	if err := cj.updateCronJobObject(client, job); err != nil {
+	if err := cj.updateCronJobObject(ctx, client, job); err != nil {
 		return err
 	}
+	cj.updated = job.Name
 
 	return nil
 }
 
-// rollback is a noop for CronJobs because they do not support rollbacks in
+func (cj *cronjob) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	job, err := cj.getCurrentJob(ctx, client, obj)
+	if err != nil {
+		return "", err
+	}
+
+	return describeImageChanges(
+		"CronJob",
+		job.Name,
+		job.Labels,
+		image,
+		tag,
+		job.Spec.JobTemplate.Spec.Template.Spec.Containers,
+	), nil
+}
+
+// rollback restores the images and version labels recorded in the
+// CronJob's previousAnnotation, since CronJobs do not support rollbacks in
 // the Kubernetes API.
-func (cj *cronjob) rollback(_ *kubernetes.Clientset, _ string) error {
+func (cj *cronjob) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	job, previous, err := cj.updatedJob(ctx, client, obj)
+	if err != nil || job == nil {
+		return err
+	}
+
+	containers := job.Spec.JobTemplate.Spec.Template.Spec.Containers
+	for idx := range containers {
+		if image, ok := previous.Images[containers[idx].Name]; ok {
+			containers[idx].Image = image
+		}
+	}
+	setVersionLabel(job.Labels, previous.Version)
+	setVersionLabel(job.Spec.JobTemplate.Labels, previous.TemplateVersion)
+	delete(job.Annotations, previousAnnotation)
+
+	if err := cj.updateCronJobObject(ctx, client, job); err != nil {
+		return err
+	}
+
+	cj.updated = ""
 	return nil
 }
 
-// getCurrentJob retrieves the Cron Job object whose "app" label
-// matches the "name" from Forge's config.
+// updatedJob finds the CronJob that this deploy updated, and the snapshot it
+// recorded before the update, or returns nil if it didn't update one. An
+// update can be applied even though it reports an error, such as a timeout,
+// so when the CronJob isn't known to be updated, it is looked for by the
+// snapshot that the deploy recorded on it.
+func (cj *cronjob) updatedJob(
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
+) (
+	*batchv1.CronJob,
+	*cronJobSnapshot,
+	error,
+) {
+	var job *batchv1.CronJob
+	var err error
+	if cj.updated != "" {
+		job, err = client.BatchV1().
+			CronJobs(obj.namespace).
+			Get(ctx, cj.updated, metav1.GetOptions{})
+	} else if cj.deploy != "" {
+		job, err = cj.getCurrentJob(ctx, client, obj)
+	} else {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previous, err := readSnapshot(job)
+	if cj.updated != "" && err != nil {
+		return nil, nil, err
+	} else if cj.updated == "" && (err != nil || previous.Deploy != cj.deploy) {
+		return nil, nil, nil
+	}
+	return job, previous, nil
+}
+
+// deployed always reports CronJobs as healthy, since there is nothing rolling
+// out between runs.
+func (cj *cronjob) deployed(ctx context.Context, client kubernetes.Interface, obj object) (string, bool, error) {
+	job, err := cj.getCurrentJob(ctx, client, obj)
+	if err != nil {
+		return "", false, err
+	}
+	return job.Labels["version"], true, nil
+}
+
+// status describes the schedule of the CronJob, since it has no replicas.
+func (cj *cronjob) status(ctx context.Context, client kubernetes.Interface, obj object, image string) (engine.Status, error) {
+	job, err := cj.getCurrentJob(ctx, client, obj)
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	details := fmt.Sprintf("schedule %q", job.Spec.Schedule)
+	if job.Spec.Suspend != nil && *job.Spec.Suspend {
+		details += ", suspended"
+	}
+	if job.Status.LastScheduleTime != nil {
+		details += fmt.Sprintf(", last run %v", job.Status.LastScheduleTime.Format(time.RFC822))
+	}
+
+	return engine.Status{
+		Version: job.Labels["version"],
+		Image:   containerImage(image, job.Spec.JobTemplate.Spec.Template.Spec.Containers),
+		Details: details,
+	}, nil
+}
+
+// getCurrentJob retrieves the Cron Job object in obj's namespace that
+// matches its selector.
 func (cj *cronjob) getCurrentJob(
-	client *kubernetes.Clientset,
-	name string,
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
 ) (
-	*v1beta1.CronJob,
+	*batchv1.CronJob,
 	error,
 ) {
-	jobs, err := client.BatchV1beta1().
-		CronJobs(k8Namespace).
-		List(metav1.ListOptions{
-			LabelSelector: fmt.Sprintf("app=%v", name),
+	jobs, err := client.BatchV1().
+		CronJobs(obj.namespace).
+		List(ctx, metav1.ListOptions{
+			LabelSelector: obj.selector,
 		})
 
 	if err != nil {
@@ -57,10 +208,50 @@ func (cj *cronjob) getCurrentJob(
 	return &jobs.Items[0], nil
 }
 
+// recordPrevious stores the CronJob's current images and version labels in
+// its previousAnnotation. If this deploy already recorded them, for example
+// before an update that was applied but reported an error and is being
+// retried, the CronJob already runs the new images, so the snapshot is kept.
+func (cj *cronjob) recordPrevious(jobObj *batchv1.CronJob) error {
+	if recorded, err := readSnapshot(jobObj); err == nil && recorded.Deploy == cj.deploy {
+		return nil
+	}
+
+	previous := cronJobSnapshot{
+		Deploy:          cj.deploy,
+		Version:         jobObj.Labels["version"],
+		TemplateVersion: jobObj.Spec.JobTemplate.Labels["version"],
+		Images:          make(map[string]string),
+	}
+	for _, c := range jobObj.Spec.JobTemplate.Spec.Template.Spec.Containers {
+		previous.Images[c.Name] = c.Image
+	}
+
+	body, err := json.Marshal(previous)
+	if err != nil {
+		return err
+	}
+
+	if jobObj.Annotations == nil {
+		jobObj.Annotations = make(map[string]string)
+	}
+	jobObj.Annotations[previousAnnotation] = string(body)
+	return nil
+}
+
+// readSnapshot reads the snapshot in the CronJob's previousAnnotation.
+func readSnapshot(jobObj *batchv1.CronJob) (*cronJobSnapshot, error) {
+	var previous cronJobSnapshot
+	if err := json.Unmarshal([]byte(jobObj.Annotations[previousAnnotation]), &previous); err != nil {
+		return nil, fmt.Errorf("Couldn't read the %v annotation of CronJob %q: %v", previousAnnotation, jobObj.Name, err)
+	}
+	return &previous, nil
+}
+
 // updateObject updates the cron job object's container.image to the use the
 // new `tag`.
 func (cj *cronjob) updateObject(
-	jobObj *v1beta1.CronJob,
+	jobObj *batchv1.CronJob,
 	image string,
 	tag string,
 ) {
@@ -81,9 +272,22 @@ func (cj *cronjob) updateObject(
 }
 
 func (cj *cronjob) updateCronJobObject(
-	client *kubernetes.Clientset,
-	jobObj *v1beta1.CronJob,
+	ctx context.Context,
+	client kubernetes.Interface,
+	jobObj *batchv1.CronJob,
 ) error {
-	_, err := client.BatchV1beta1().CronJobs(k8Namespace).Update(jobObj)
+	_, err := client.BatchV1().
+		CronJobs(jobObj.Namespace).
+		Update(ctx, jobObj, metav1.UpdateOptions{})
 	return err
 }
+
+// setVersionLabel sets the "version" label to version, or removes it if
+// version is empty.
+func setVersionLabel(labels map[string]string, version string) {
+	if version == "" {
+		delete(labels, "version")
+		return
+	}
+	labels["version"] = version
+}
@@ -0,0 +1,115 @@
+package k8
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// testCronJob is a CronJob of testObject running v1.
+func testCronJob() *batchv1.CronJob {
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			Labels:    map[string]string{"app": "web", "version": "v1"},
+		},
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"version": "v1"}},
+				Spec: batchv1.JobSpec{
+					Template: v1.PodTemplateSpec{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "web", Image: "gcr.io/acme/web:v1"}},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// failAppliedUpdates makes every CronJob update fail after it was applied,
+// like an update that times out.
+func failAppliedUpdates(client *fake.Clientset) {
+	client.PrependReactor("update", "cronjobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.UpdateAction).GetObject()
+		if err := client.Tracker().Update(action.GetResource(), obj, action.GetNamespace()); err != nil {
+			return true, nil, err
+		}
+		return true, nil, errors.New("timed out")
+	})
+}
+
+func getCronJob(t *testing.T, client kubernetes.Interface) *batchv1.CronJob {
+	job, err := client.BatchV1().CronJobs("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestCronJobRetryKeepsTheFirstSnapshot(t *testing.T) {
+	client := fake.NewSimpleClientset(testCronJob())
+	failAppliedUpdates(client)
+
+	cj := &cronjob{}
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := cj.update(context.Background(), client, testObject, "gcr.io/acme/web", "v2"); err == nil {
+			t.Fatal("The update succeeded, expected the injected error")
+		}
+	}
+
+	previous, err := readSnapshot(getCronJob(t, client))
+	if err != nil {
+		t.Fatal(err)
+	} else if previous.Images["web"] != "gcr.io/acme/web:v1" || previous.Version != "v1" {
+		t.Errorf("The snapshot holds %v, expected the v1 image and version", previous)
+	}
+}
+
+func TestCronJobRollbackAfterAnAppliedUpdateFailed(t *testing.T) {
+	client := fake.NewSimpleClientset(testCronJob())
+	failAppliedUpdates(client)
+
+	cj := &cronjob{}
+	if err := cj.update(context.Background(), client, testObject, "gcr.io/acme/web", "v2"); err == nil {
+		t.Fatal("The update succeeded, expected the injected error")
+	}
+
+	client.ReactionChain = client.ReactionChain[1:]
+	if err := cj.rollback(context.Background(), client, testObject); err != nil {
+		t.Fatalf("The rollback failed: %v", err)
+	}
+
+	job := getCronJob(t, client)
+	if image := job.Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image; image != "gcr.io/acme/web:v1" {
+		t.Errorf("The CronJob runs %v after the rollback, expected gcr.io/acme/web:v1", image)
+	}
+	if _, ok := job.Annotations[previousAnnotation]; ok {
+		t.Error("The rollback left the snapshot behind")
+	}
+}
+
+func TestCronJobRollbackIgnoresAnotherDeploysSnapshot(t *testing.T) {
+	job := testCronJob()
+	job.Annotations = map[string]string{previousAnnotation: `{"deploy":"earlier","version":"v0","images":{"web":"gcr.io/acme/web:v0"}}`}
+	client := fake.NewSimpleClientset(job)
+
+	cj := &cronjob{deploy: "current"}
+	if err := cj.rollback(context.Background(), client, testObject); err != nil {
+		t.Fatalf("The rollback failed: %v", err)
+	}
+
+	if image := getCronJob(t, client).Spec.JobTemplate.Spec.Template.Spec.Containers[0].Image; image != "gcr.io/acme/web:v1" {
+		t.Errorf("The rollback restored %v from an earlier deploy's snapshot", image)
+	}
+}
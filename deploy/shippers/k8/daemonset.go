@@ -0,0 +1,206 @@
+package k8
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// daemonSet updates a DaemonSet and waits for the new version to be
+// available on every node the DaemonSet should run on.
+type daemonSet struct {
+	// The name of the DaemonSet once it has been updated, and the pod
+	// template it had before, so that it can be rolled back.
+	updated  string
+	previous *v1.PodTemplateSpec
+}
+
+func (ds *daemonSet) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	set, err := ds.getCurrentDaemonSet(ctx, client, obj)
+	if err != nil {
+		return err
+	}
+
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	previous := set.Spec.Template.DeepCopy()
+	ds.updateObject(set, image, tag)
+
+	if _, err := client.AppsV1().DaemonSets(set.Namespace).Update(ctx, set, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	ds.updated = set.Name
+	ds.previous = previous
+
+	if set.Spec.UpdateStrategy.Type == appsv1.OnDeleteDaemonSetStrategyType {
+		engine.Warn(ctx, "DaemonSet %v uses the OnDelete strategy, its pods only run %v once they are deleted", set.Name, tag)
+		return nil
+	}
+	return ds.waitForNodes(ctx, client, set, obj.pods(tag))
+}
+
+// waitForNodes waits for the DaemonSet's updated pods to be available on
+// every node that should run one. It fails as soon as one of the new pods
+// matching selector is stuck failing.
+func (ds *daemonSet) waitForNodes(
+	ctx context.Context,
+	client kubernetes.Interface,
+	set *appsv1.DaemonSet,
+	selector string,
+) error {
+	var reported int32 = -1
+
+	return waitForRollout(ctx, func() (bool, error) {
+		current, err := client.AppsV1().
+			DaemonSets(set.Namespace).
+			Get(ctx, set.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		} else if current.Status.ObservedGeneration < current.Generation {
+			return false, nil
+		}
+
+		if err := checkPodsFailed(ctx, client, set.Namespace, selector); err != nil {
+			return false, err
+		}
+
+		status := current.Status
+		if status.UpdatedNumberScheduled != reported {
+			reported = status.UpdatedNumberScheduled
+			engine.Progress(ctx, "Updated %d of %d node(s)", reported, status.DesiredNumberScheduled)
+		}
+		return isDaemonSetHealthy(current), nil
+	})
+}
+
+func (ds *daemonSet) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	set, err := ds.getCurrentDaemonSet(ctx, client, obj)
+	if err != nil {
+		return "", err
+	}
+
+	return describeImageChanges(
+		"DaemonSet",
+		set.Name,
+		set.Labels,
+		image,
+		tag,
+		set.Spec.Template.Spec.Containers,
+	), nil
+}
+
+// rollback restores the pod template the DaemonSet had before it was
+// updated.
+func (ds *daemonSet) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	if ds.updated == "" {
+		return nil
+	}
+
+	sets := client.AppsV1().DaemonSets(obj.namespace)
+	set, err := sets.Get(ctx, ds.updated, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	set.Spec.Template = *ds.previous
+	if version, ok := ds.previous.Labels["version"]; ok {
+		set.Labels["version"] = version
+	}
+	if _, err := sets.Update(ctx, set, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	ds.updated = ""
+	return nil
+}
+
+// deployed reports the DaemonSet as healthy once its updated pods are
+// available on every node.
+func (ds *daemonSet) deployed(ctx context.Context, client kubernetes.Interface, obj object) (string, bool, error) {
+	set, err := ds.getCurrentDaemonSet(ctx, client, obj)
+	if err != nil {
+		return "", false, err
+	}
+	return set.Labels["version"], isDaemonSetHealthy(set), nil
+}
+
+// status counts the nodes with a ready pod against the nodes that should run
+// one.
+func (ds *daemonSet) status(ctx context.Context, client kubernetes.Interface, obj object, image string) (engine.Status, error) {
+	set, err := ds.getCurrentDaemonSet(ctx, client, obj)
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	return engine.Status{
+		Version: set.Labels["version"],
+		Image:   containerImage(image, set.Spec.Template.Spec.Containers),
+		Replicas: &engine.Replicas{
+			Ready:   int(set.Status.NumberReady),
+			Desired: int(set.Status.DesiredNumberScheduled),
+		},
+	}, nil
+}
+
+// getCurrentDaemonSet retrieves the DaemonSet in obj's namespace that
+// matches its selector.
+func (ds *daemonSet) getCurrentDaemonSet(
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
+) (
+	*appsv1.DaemonSet,
+	error,
+) {
+	sets, err := client.AppsV1().
+		DaemonSets(obj.namespace).
+		List(ctx, metav1.ListOptions{
+			LabelSelector: obj.selector,
+		})
+
+	if err != nil {
+		return nil, err
+	} else if len(sets.Items) > 1 {
+		return nil, ErrNonUniqueName
+	} else if len(sets.Items) < 1 {
+		return nil, ErrUnmatchedName
+	}
+
+	return &sets.Items[0], nil
+}
+
+// updateObject updates the DaemonSet's container.image and version labels to
+// the new `tag`.
+func (ds *daemonSet) updateObject(set *appsv1.DaemonSet, image, tag string) {
+	containers := updateContainerImages(
+		image,
+		tag,
+		set.Spec.Template.Spec.Containers,
+	)
+
+	if set.Spec.Template.Labels == nil {
+		set.Spec.Template.Labels = make(map[string]string)
+	}
+
+	set.Labels["version"] = tag
+	set.Spec.Template.Labels["version"] = tag
+	set.Spec.Template.Spec.Containers = containers
+}
+
+// isDaemonSetHealthy reports whether the DaemonSet's latest generation is
+// available on every node it should run on.
+func isDaemonSetHealthy(set *appsv1.DaemonSet) bool {
+	status := set.Status
+	return status.ObservedGeneration >= set.Generation &&
+		status.UpdatedNumberScheduled == status.DesiredNumberScheduled &&
+		status.NumberAvailable == status.DesiredNumberScheduled &&
+		status.NumberUnavailable == 0
+}
@@ -1,71 +1,194 @@
 package k8
 
 import (
+	"context"
 	"fmt"
 
-	"k8s.io/api/extensions/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
 )
 
+// revisionAnnotation is where the Deployment controller records the
+// revision of a Deployment and of each of its ReplicaSets.
+const revisionAnnotation = "deployment.kubernetes.io/revision"
+
 type deployment struct {
-	// Set to true if the deployment has reached the point that a rollback
-	// should be triggered.
-	needsRollback bool
+	// The name of the Deployment once it has been updated, so that it can be
+	// rolled back. Empty if nothing needs a rollback.
+	updated string
+
+	// The revision the Deployment was at before it was updated. Its
+	// ReplicaSet holds the pod template that a rollback restores.
+	revision string
 }
 
-func (d *deployment) update(client *kubernetes.Clientset, name, image, tag string) error {
-	deployment, err := d.getCurrentDeployment(client, name)
+func (d *deployment) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	deployment, err := d.getCurrentDeployment(ctx, client, obj)
 	if err != nil {
 		return err
 	}
 
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.rollForward(ctx, client, deployment, image, tag, obj.pods(tag))
+}
+
+// rollForward updates the deployment to the new tag and waits for the pods
+// in its namespace matching selector to start.
+func (d *deployment) rollForward(
+	ctx context.Context,
+	client kubernetes.Interface,
+	deployment *appsv1.Deployment,
+	image string,
+	tag string,
+	selector string,
+) error {
+	revision := deployment.Annotations[revisionAnnotation]
 	d.updateDeploymentObject(deployment, image, tag)
 
-	if err := d.updateK8Deployment(client, deployment); err != nil {
+	if err := d.updateK8Deployment(ctx, client, deployment); err != nil {
 		return err
 	}
-	d.needsRollback = true
+	d.updated = deployment.Name
+	d.revision = revision
 
 	watcher := newK8DeployWatcher()
-	err = watcher.watchIt(
+	return watcher.watchIt(
+		ctx,
 		client,
-		name,
-		tag,
+		deployment.Namespace,
+		selector,
 		*deployment.Spec.Replicas,
 		deployment.Status.ObservedGeneration,
 	)
+}
+
+func (d *deployment) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	deployment, err := d.getCurrentDeployment(ctx, client, obj)
+	if err != nil {
+		return "", err
+	}
+
+	return describeImageChanges(
+		"Deployment",
+		deployment.Name,
+		deployment.Labels,
+		image,
+		tag,
+		deployment.Spec.Template.Spec.Containers,
+	), nil
+}
+
+// rollback restores the pod template of the ReplicaSet that the Deployment
+// was running before it was updated, like `kubectl rollout undo`.
+func (d *deployment) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	if d.updated == "" {
+		return nil
+	}
+
+	deployments := client.AppsV1().Deployments(obj.namespace)
+	deployment, err := deployments.Get(ctx, d.updated, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
 
+	previous, err := d.previousReplicaSet(ctx, client, deployment)
+	if err != nil {
+		return err
+	}
+
+	template := previous.Spec.Template.DeepCopy()
+	// The controller adds this label to every ReplicaSet's template, and it
+	// mustn't end up in the Deployment's.
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+
+	deployment.Spec.Template = *template
+	if version, ok := template.Labels["version"]; ok {
+		deployment.Labels["version"] = version
+	}
+	if _, err := deployments.Update(ctx, deployment, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+
+	d.updated = ""
 	return nil
 }
 
-func (d *deployment) rollback(client *kubernetes.Clientset, name string) error {
-	if !d.needsRollback {
-		return nil
+// previousReplicaSet finds the Deployment's ReplicaSet at the revision it was
+// at before it was updated.
+func (d *deployment) previousReplicaSet(
+	ctx context.Context,
+	client kubernetes.Interface,
+	deployment *appsv1.Deployment,
+) (
+	*appsv1.ReplicaSet,
+	error,
+) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	replicaSets, err := client.AppsV1().
+		ReplicaSets(deployment.Namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
 	}
 
-	rollback := &v1beta1.DeploymentRollback{Name: name}
-	return client.ExtensionsV1beta1().
-		Deployments(k8Namespace).
-		Rollback(rollback)
+	for idx := range replicaSets.Items {
+		rs := &replicaSets.Items[idx]
+		if metav1.IsControlledBy(rs, deployment) && rs.Annotations[revisionAnnotation] == d.revision {
+			return rs, nil
+		}
+	}
+	return nil, fmt.Errorf(
+		"There is no ReplicaSet at revision %q of Deployment %q to roll back to",
+		d.revision,
+		deployment.Name,
+	)
+}
+
+// deployed reports the Deployment as healthy once its latest generation has
+// rolled out to every replica.
+func (d *deployment) deployed(ctx context.Context, client kubernetes.Interface, obj object) (string, bool, error) {
+	deployment, err := d.getCurrentDeployment(ctx, client, obj)
+	if err != nil {
+		return "", false, err
+	}
+
+	return deployment.Labels["version"], isDeploymentHealthy(deployment), nil
+}
+
+// status counts the ready replicas against the number the Deployment wants.
+func (d *deployment) status(ctx context.Context, client kubernetes.Interface, obj object, image string) (engine.Status, error) {
+	deployment, err := d.getCurrentDeployment(ctx, client, obj)
+	if err != nil {
+		return engine.Status{}, err
+	}
+	return deploymentStatus(deployment, image), nil
 }
 
-// getCurrentDeployment retrieves the deployment object whose "app" label
-// matches the "name" from Forge's config.
+// getCurrentDeployment retrieves the deployment object in obj's namespace
+// that matches its selector. Canary Deployments are never matched.
 func (d *deployment) getCurrentDeployment(
-	client *kubernetes.Clientset,
-	name string,
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
 ) (
-	*v1beta1.Deployment,
+	*appsv1.Deployment,
 	error,
 ) {
-	deployments, err := client.ExtensionsV1beta1().
-		Deployments(k8Namespace).
-		List(metav1.ListOptions{
-			LabelSelector: fmt.Sprintf("app=%v", name),
+	deployments, err := client.AppsV1().
+		Deployments(obj.namespace).
+		List(ctx, metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%v,%v!=%v", obj.selector, trackLabel, trackCanary),
 		})
 
 	if err != nil {
@@ -82,7 +205,7 @@ func (d *deployment) getCurrentDeployment(
 // updateDeploymentObject updates the deployment object's container.image to
 // the new `tag`.
 func (d *deployment) updateDeploymentObject(
-	deployment *v1beta1.Deployment,
+	deployment *appsv1.Deployment,
 	image string,
 	tag string,
 ) {
@@ -103,9 +226,76 @@ func (d *deployment) updateDeploymentObject(
 }
 
 func (d *deployment) updateK8Deployment(
-	client *kubernetes.Clientset,
-	deployment *v1beta1.Deployment,
+	ctx context.Context,
+	client kubernetes.Interface,
+	deployment *appsv1.Deployment,
 ) error {
-	_, err := client.ExtensionsV1beta1().Deployments(k8Namespace).Update(deployment)
+	_, err := client.AppsV1().
+		Deployments(deployment.Namespace).
+		Update(ctx, deployment, metav1.UpdateOptions{})
 	return err
 }
+
+// waitForDeployment waits for the Deployment's latest generation to roll out
+// to every replica. It fails as soon as one of its pods matching selector is
+// stuck failing.
+func waitForDeployment(
+	ctx context.Context,
+	client kubernetes.Interface,
+	deployment *appsv1.Deployment,
+	selector string,
+) error {
+	var reported int32 = -1
+
+	return waitForRollout(ctx, func() (bool, error) {
+		current, err := client.AppsV1().
+			Deployments(deployment.Namespace).
+			Get(ctx, deployment.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		} else if current.Status.ObservedGeneration < current.Generation {
+			return false, nil
+		}
+
+		if err := checkPodsFailed(ctx, client, deployment.Namespace, selector); err != nil {
+			return false, err
+		}
+
+		if current.Status.UpdatedReplicas != reported {
+			reported = current.Status.UpdatedReplicas
+			engine.Progress(ctx, "Updated %d of %d replica(s) of Deployment %v", reported, desiredReplicas(current), current.Name)
+		}
+		return isDeploymentHealthy(current), nil
+	})
+}
+
+// desiredReplicas returns the number of replicas the Deployment asks for,
+// which Kubernetes defaults to 1.
+func desiredReplicas(deployment *appsv1.Deployment) int32 {
+	if deployment.Spec.Replicas != nil {
+		return *deployment.Spec.Replicas
+	}
+	return 1
+}
+
+// isDeploymentHealthy reports whether the Deployment's latest generation has
+// rolled out to every replica.
+func isDeploymentHealthy(deployment *appsv1.Deployment) bool {
+	replicas := desiredReplicas(deployment)
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.AvailableReplicas >= replicas &&
+		status.UnavailableReplicas == 0
+}
+
+func deploymentStatus(deployment *appsv1.Deployment, image string) engine.Status {
+	return engine.Status{
+		Version: deployment.Labels["version"],
+		Image:   containerImage(image, deployment.Spec.Template.Spec.Containers),
+		Replicas: &engine.Replicas{
+			Ready:   int(deployment.Status.ReadyReplicas),
+			Desired: int(desiredReplicas(deployment)),
+		},
+	}
+}
@@ -1,10 +1,14 @@
 package k8
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"time"
+
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -38,21 +42,33 @@ func newK8DeployWatcher() *k8DeployWatcher {
 	}
 }
 
-// watchIt watches events on a K8 pods with the appropriate `name` and
-// `version` labels and returns an error if at least `expectedReplicas` are
-// not deployed successfully.
-func (kdw *k8DeployWatcher) watchIt(client *kubernetes.Clientset, name, version string, expectedReplicas int32, gen int64) error {
+// watchIt watches events on the K8 pods in `namespace` matching `selector`,
+// usually built with object.pods, and returns an error if at least
+// `expectedReplicas` are not deployed successfully. It stops watching and
+// returns the context's error if ctx is canceled first.
+func (kdw *k8DeployWatcher) watchIt(ctx context.Context, client kubernetes.Interface, namespace, selector string, expectedReplicas int32, gen int64) error {
 	podWatcher, err := client.CoreV1().
-		Pods(k8Namespace).
-		Watch(metav1.ListOptions{
-			LabelSelector: fmt.Sprintf("app=%v,version=%v", name, version),
+		Pods(namespace).
+		Watch(ctx, metav1.ListOptions{
+			LabelSelector: selector,
 		})
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
+	defer podWatcher.Stop()
+
+	for {
+		var event watch.Event
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-podWatcher.ResultChan():
+			if !ok {
+				return nil
+			}
+			event = e
+		}
 
-	for event := range podWatcher.ResultChan() {
 		pod, ok := event.Object.(*v1.Pod)
 		if !ok {
 			continue
@@ -76,8 +92,6 @@ func (kdw *k8DeployWatcher) watchIt(client *kubernetes.Clientset, name, version
 			}
 		}
 	}
-
-	return nil
 }
 
 // inspectPodStatus evaluates the pod's status and container condition's to
@@ -116,3 +130,74 @@ func (kdw *k8DeployWatcher) isAcceptableWaitingState(state *v1.ContainerStateWai
 	}
 	return false
 }
+
+// bakeCheckInterval is how often bake checks on the pods.
+var bakeCheckInterval = 10 * time.Second
+
+// bake keeps an eye on the pods in namespace matching selector for `duration`, and fails
+// as soon as one of them stops being ready or restarts more than maxRestarts
+// times.
+func (kdw *k8DeployWatcher) bake(
+	ctx context.Context,
+	client kubernetes.Interface,
+	namespace string,
+	selector string,
+	duration time.Duration,
+	maxRestarts int32,
+) error {
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(bakeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := kdw.checkHealth(ctx, client, namespace, selector, maxRestarts); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return kdw.checkHealth(ctx, client, namespace, selector, maxRestarts)
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkHealth fails if there are no pods in namespace matching selector, or
+// if any of them isn't ready or has restarted more than maxRestarts times.
+func (kdw *k8DeployWatcher) checkHealth(ctx context.Context, client kubernetes.Interface, namespace, selector string, maxRestarts int32) error {
+	pods, err := client.CoreV1().
+		Pods(namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	} else if len(pods.Items) == 0 {
+		return fmt.Errorf("No pods match %q", selector)
+	}
+
+	for _, pod := range pods.Items {
+		if !isPodReady(&pod) {
+			return fmt.Errorf("The pod %q is not ready", pod.Name)
+		}
+
+		var restarts int32
+		for _, stat := range pod.Status.ContainerStatuses {
+			restarts += stat.RestartCount
+		}
+		if restarts > maxRestarts {
+			return fmt.Errorf("The pod %q restarted %d time(s)", pod.Name, restarts)
+		}
+	}
+	return nil
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == v1.PodReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -2,6 +2,10 @@ package k8
 
 import (
 	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	"github.com/ki4jnq/forge/deploy/engine"
 )
 
 type ConfigErr struct {
@@ -11,3 +15,18 @@ type ConfigErr struct {
 func (mce ConfigErr) Error() string {
 	return fmt.Sprintf("Error while looking up option \"%v\"\n", mce.opt)
 }
+
+// classifyErr marks errors from the Kubernetes API that are likely to go away
+// on their own as transient, so the engine can retry them.
+func classifyErr(err error) error {
+	switch {
+	case apierrors.IsServerTimeout(err),
+		apierrors.IsTimeout(err),
+		apierrors.IsTooManyRequests(err),
+		apierrors.IsInternalError(err),
+		apierrors.IsServiceUnavailable(err):
+		return engine.Transient(err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,210 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// The labels that Kubernetes generates for the pods of every Job, both the
+// legacy ones and the batch.kubernetes.io ones that replace them. They tie
+// the pods to one Job, so they are never copied into a new one.
+var generatedJobLabels = [...]string{
+	"controller-uid",
+	"job-name",
+	"batch.kubernetes.io/controller-uid",
+	"batch.kubernetes.io/job-name",
+}
+
+// job runs a one-off Job for every deploy. The newest Job that matches the
+// selector is copied into a new Job that runs the new tag, and the deploy
+// waits for it to complete. Rolling back deletes the new Job.
+type job struct {
+	// The name of the Job created by the deploy, so that it can be deleted.
+	created string
+}
+
+func (j *job) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	latest, err := j.getLatestJob(ctx, client, obj)
+	if err != nil {
+		return err
+	}
+
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	created, err := client.BatchV1().
+		Jobs(obj.namespace).
+		Create(ctx, j.jobObject(obj, latest, image, tag), metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+	j.created = created.Name
+
+	engine.Progress(ctx, "Waiting for Job %v to complete", created.Name)
+	return waitForRollout(ctx, func() (bool, error) {
+		current, err := client.BatchV1().
+			Jobs(obj.namespace).
+			Get(ctx, created.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return jobFinished(current)
+	})
+}
+
+func (j *job) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	latest, err := j.getLatestJob(ctx, client, obj)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(
+		"Would run a new Job copied from %q and wait for it to complete:\n%v",
+		latest.Name,
+		describeImageChanges(
+			"Job",
+			latest.Name,
+			latest.Labels,
+			image,
+			tag,
+			latest.Spec.Template.Spec.Containers,
+		),
+	), nil
+}
+
+// rollback deletes the Job that the deploy created, along with its pods.
+// Whatever the Job already did is not undone.
+func (j *job) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	if j.created == "" {
+		return nil
+	}
+
+	policy := metav1.DeletePropagationBackground
+	err := client.BatchV1().
+		Jobs(obj.namespace).
+		Delete(ctx, j.created, metav1.DeleteOptions{PropagationPolicy: &policy})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	j.created = ""
+	return nil
+}
+
+// deployed reports the newest Job as healthy once it has completed.
+func (j *job) deployed(ctx context.Context, client kubernetes.Interface, obj object) (string, bool, error) {
+	latest, err := j.getLatestJob(ctx, client, obj)
+	if err != nil {
+		return "", false, err
+	}
+
+	done, err := jobFinished(latest)
+	return latest.Labels["version"], done && err == nil, nil
+}
+
+// status describes the newest Job, which has no replicas to count.
+func (j *job) status(ctx context.Context, client kubernetes.Interface, obj object, image string) (engine.Status, error) {
+	latest, err := j.getLatestJob(ctx, client, obj)
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	details := fmt.Sprintf("%v running", latest.Name)
+	if done, err := jobFinished(latest); err != nil {
+		details = fmt.Sprintf("%v failed", latest.Name)
+	} else if done {
+		details = fmt.Sprintf("%v complete", latest.Name)
+	}
+
+	return engine.Status{
+		Version: latest.Labels["version"],
+		Image:   containerImage(image, latest.Spec.Template.Spec.Containers),
+		Details: details,
+	}, nil
+}
+
+// getLatestJob retrieves the most recently created Job in obj's namespace
+// that matches its selector.
+func (j *job) getLatestJob(
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
+) (
+	*batchv1.Job,
+	error,
+) {
+	jobs, err := client.BatchV1().
+		Jobs(obj.namespace).
+		List(ctx, metav1.ListOptions{
+			LabelSelector: obj.selector,
+		})
+
+	if err != nil {
+		return nil, err
+	} else if len(jobs.Items) < 1 {
+		return nil, ErrUnmatchedName
+	}
+
+	latest := &jobs.Items[0]
+	for idx := range jobs.Items {
+		if latest.CreationTimestamp.Before(&jobs.Items[idx].CreationTimestamp) {
+			latest = &jobs.Items[idx]
+		}
+	}
+	return latest, nil
+}
+
+// jobObject builds a new Job from a copy of `latest` that runs the new tag.
+// Kubernetes names it after obj.
+func (j *job) jobObject(obj object, latest *batchv1.Job, image, tag string) *batchv1.Job {
+	newJob := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: obj.name + "-",
+			Namespace:    latest.Namespace,
+			Labels:       copyLabels(latest.Labels),
+		},
+		Spec: *latest.Spec.DeepCopy(),
+	}
+
+	// Let Kubernetes generate the selector for the new Job's pods.
+	newJob.Spec.Selector = nil
+	newJob.Spec.ManualSelector = nil
+	newJob.Spec.Template.Labels = copyLabels(latest.Spec.Template.Labels)
+	for _, label := range generatedJobLabels {
+		delete(newJob.Labels, label)
+		delete(newJob.Spec.Template.Labels, label)
+	}
+
+	newJob.Labels["version"] = tag
+	newJob.Spec.Template.Labels["version"] = tag
+	newJob.Spec.Template.Spec.Containers = updateContainerImages(image, tag, newJob.Spec.Template.Spec.Containers)
+	return newJob
+}
+
+// jobFinished reports whether the Job has completed, or returns an error if
+// it has failed.
+func jobFinished(job *batchv1.Job) (bool, error) {
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != v1.ConditionTrue {
+			continue
+		}
+
+		switch cond.Type {
+		case batchv1.JobComplete:
+			return true, nil
+		case batchv1.JobFailed:
+			return false, fmt.Errorf("The Job %q failed: %v", job.Name, cond.Message)
+		}
+	}
+	return false, nil
+}
@@ -4,9 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strings"
-
-	"io/ioutil"
 
 	"k8s.io/client-go/kubernetes"
 
@@ -18,9 +15,40 @@ var (
 	ErrUnmatchedName = errors.New("The resource could not be found on this Kubernetes cluster.")
 )
 
+// The update strategies for Deployments.
+const (
+	strategyRolling   = "rolling"
+	strategyCanary    = "canary"
+	strategyBlueGreen = "blue-green"
+)
+
 type updater interface {
-	update(cl *kubernetes.Clientset, name, image, tag string) error
-	rollback(cl *kubernetes.Clientset, name string) error
+	update(ctx context.Context, cl kubernetes.Interface, obj object, image, tag string) error
+	plan(ctx context.Context, cl kubernetes.Interface, obj object, image, tag string) (string, error)
+	rollback(ctx context.Context, cl kubernetes.Interface, obj object) error
+
+	// deployed returns the version the object is labelled with, and whether
+	// it is healthy.
+	deployed(ctx context.Context, cl kubernetes.Interface, obj object) (version string, healthy bool, err error)
+
+	// status describes what the object is running.
+	status(ctx context.Context, cl kubernetes.Interface, obj object, image string) (engine.Status, error)
+}
+
+// object identifies the Kubernetes object that a shipper updates.
+type object struct {
+	// name is the "name" option. The canary and blue-green strategies name
+	// the Deployments they create after it.
+	name      string
+	namespace string
+
+	// selector is a label selector that matches the object and its pods.
+	selector string
+}
+
+// pods selects the object's pods that run `version`.
+func (o object) pods(version string) string {
+	return fmt.Sprintf("%v,version=%v", o.selector, version)
 }
 
 type K8 struct {
@@ -45,9 +73,53 @@ func NewCronShipper(opts map[string]interface{}) *K8 {
 	return shipper
 }
 
+func NewStatefulSetShipper(opts map[string]interface{}) *K8 {
+	shipper := newK8Shipper(opts)
+	shipper.updater = &statefulSet{}
+	return shipper
+}
+
+func NewDaemonSetShipper(opts map[string]interface{}) *K8 {
+	shipper := newK8Shipper(opts)
+	shipper.updater = &daemonSet{}
+	return shipper
+}
+
+// NewJobShipper builds a shipper that runs a new copy of a Job with every
+// deploy.
+func NewJobShipper(opts map[string]interface{}) *K8 {
+	shipper := newK8Shipper(opts)
+	shipper.updater = &job{}
+	return shipper
+}
+
+// NewDeploymentShipper builds a shipper for a Deployment. The "strategy"
+// option picks how it is updated: "rolling", the default, updates it in
+// place, "canary" tries the new version out in a canary Deployment first, and
+// "blue-green" switches a Service between two Deployments.
 func NewDeploymentShipper(opts map[string]interface{}) *K8 {
 	shipper := newK8Shipper(opts)
-	shipper.updater = &deployment{}
+
+	switch strategy, _ := opts["strategy"].(string); strategy {
+	case "", strategyRolling:
+		shipper.updater = &deployment{}
+	case strategyCanary:
+		c, err := newCanary(opts)
+		if err != nil {
+			panic(err)
+		}
+		shipper.updater = c
+	case strategyBlueGreen:
+		shipper.updater = newBlueGreen(opts)
+	default:
+		panic(fmt.Errorf(
+			"Unknown k8 strategy %q, expected \"%v\", \"%v\" or \"%v\"",
+			strategy,
+			strategyRolling,
+			strategyCanary,
+			strategyBlueGreen,
+		))
+	}
 	return shipper
 }
 
@@ -57,10 +129,10 @@ func (ks *K8) ShipIt(ctx context.Context) chan error {
 	// to the `ch` channel.
 	go func() {
 		defer close(ch)
-		defer ks.savePanics(ch)
+		defer savePanics(ch)
 
 		if err := ks.runDeploy(ctx); err != nil {
-			ch <- err
+			ch <- classifyErr(err)
 		}
 	}()
 	return ch
@@ -71,7 +143,7 @@ func (ks *K8) Rollback(ctx context.Context) chan error {
 
 	go func() {
 		defer close(ch)
-		defer ks.savePanics(ch)
+		defer savePanics(ch)
 
 		client, err := ks.getK8Client()
 		if err != nil {
@@ -79,14 +151,74 @@ func (ks *K8) Rollback(ctx context.Context) chan error {
 			return
 		}
 
-		ks.updater.rollback(client, ks.mustLookup("name"))
-		if err != nil {
+		if err := ks.updater.rollback(ctx, client, ks.object()); err != nil {
 			ch <- err
 		}
 	}()
 	return ch
 }
 
+// Plan describes the changes ShipIt would make to the Kubernetes object
+// without updating it.
+func (ks *K8) Plan(ctx context.Context) (plan string, err error) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			err = fmt.Errorf("%v", obj)
+		}
+	}()
+
+	tag, err := ks.readTag(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := ks.getK8Client()
+	if err != nil {
+		return "", err
+	}
+
+	return ks.updater.plan(
+		ctx,
+		client,
+		ks.object(),
+		ks.mustLookup("image"),
+		tag,
+	)
+}
+
+// DeployedVersion returns the version currently deployed to the cluster, as
+// recorded in the object's "version" label, and whether the object is
+// healthy.
+func (ks *K8) DeployedVersion(ctx context.Context) (version string, healthy bool, err error) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			err = fmt.Errorf("%v", obj)
+		}
+	}()
+
+	client, err := ks.getK8Client()
+	if err != nil {
+		return "", false, err
+	}
+	return ks.updater.deployed(ctx, client, ks.object())
+}
+
+// Status reports the image, version label and replicas of the object in the
+// cluster.
+func (ks *K8) Status(ctx context.Context) (status engine.Status, err error) {
+	defer func() {
+		if obj := recover(); obj != nil {
+			err = fmt.Errorf("%v", obj)
+		}
+	}()
+
+	client, err := ks.getK8Client()
+	if err != nil {
+		return engine.Status{}, err
+	}
+	return ks.updater.status(ctx, client, ks.object(), ks.mustLookup("image"))
+}
+
 // runDeploy coordinates all of the actual work performed during the deploy.
 func (ks *K8) runDeploy(ctx context.Context) error {
 	tag, err := ks.readTag(ctx)
@@ -99,9 +231,14 @@ func (ks *K8) runDeploy(ctx context.Context) error {
 		return err
 	}
 
+	// The updaters keep track of whether they actually changed anything, so
+	// it's safe to report the mutation before they start.
+	engine.Mutating(ctx)
+	engine.Progress(ctx, "Updating %v to %v", ks.mustLookup("name"), tag)
 	err = ks.updater.update(
+		ctx,
 		client,
-		ks.mustLookup("name"),
+		ks.object(),
 		ks.mustLookup("image"),
 		tag,
 	)
@@ -112,27 +249,35 @@ func (ks *K8) runDeploy(ctx context.Context) error {
 	return nil
 }
 
+// NeedsVersion is always true, the version is the tag of the image to
+// deploy.
+func (ks *K8) NeedsVersion() bool {
+	return true
+}
+
+// readTag returns the version being deployed, which forge deploy resolves
+// before any shipper runs.
 func (ks *K8) readTag(ctx context.Context) (string, error) {
 	version := engine.OptionsFromContext(ctx).Version
-	if version != "" {
-		return version, nil
+	if version == "" {
+		return "", engine.ErrNoVersion
 	}
-
-	buffer, err := ioutil.ReadFile("VERSION")
-	return strings.Trim(string(buffer), " \n"), err
+	return version, nil
 }
 
-// TODO: The configuration should be verified at an early step, as opposed to
-// paniking if things aren't exactly what we expect.
-func (ks *K8) mustLookup(key string) string {
-	name, ok := ks.Opts[key].(string)
-	if !ok {
-		panic(ConfigErr{key})
+// object reads the "name", "namespace" and "selector" options. The selector
+// defaults to `app=<name>`.
+func (ks *K8) object() object {
+	name := ks.mustLookup("name")
+	selector, _ := ks.Opts["selector"].(string)
+	if selector == "" {
+		selector = fmt.Sprintf("app=%v", name)
 	}
-	return name
+	return object{name: name, namespace: ks.namespace(), selector: selector}
 }
 
-func (ks *K8) savePanics(ch chan error) {
+// savePanics sends a panic in a shipper's goroutine to ch as an error.
+func savePanics(ch chan error) {
 	if obj := recover(); obj != nil {
 		switch err := obj.(type) {
 		case error:
@@ -0,0 +1,54 @@
+package k8
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// stubUpdater fails every rollback with rollbackErr.
+type stubUpdater struct {
+	rollbackErr error
+}
+
+func (su *stubUpdater) update(context.Context, kubernetes.Interface, object, string, string) error {
+	return nil
+}
+
+func (su *stubUpdater) plan(context.Context, kubernetes.Interface, object, string, string) (string, error) {
+	return "", nil
+}
+
+func (su *stubUpdater) rollback(context.Context, kubernetes.Interface, object) error {
+	return su.rollbackErr
+}
+
+func (su *stubUpdater) deployed(context.Context, kubernetes.Interface, object) (string, bool, error) {
+	return "", true, nil
+}
+
+func (su *stubUpdater) status(context.Context, kubernetes.Interface, object, string) (engine.Status, error) {
+	return engine.Status{}, nil
+}
+
+func TestRollbackReportsUpdaterErrors(t *testing.T) {
+	rollbackErr := errors.New("rollback failed")
+
+	shipper := newK8Shipper(map[string]interface{}{"name": "web"})
+	shipper.client = fake.NewSimpleClientset()
+	shipper.updater = &stubUpdater{rollbackErr: rollbackErr}
+
+	var errs []error
+	for err := range shipper.Rollback(context.Background()) {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 1 || errs[0] != rollbackErr {
+		t.Fatalf("Rollback reported %v, expected only %v", errs, rollbackErr)
+	}
+}
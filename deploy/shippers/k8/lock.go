@@ -0,0 +1,191 @@
+package k8
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/ki4jnq/forge/deploy/lock"
+)
+
+const (
+	lockNamePrefix = "forge-deploy-lock-"
+	lockHolderKey  = "holder"
+
+	// lockHolderAnnotation holds the lock.Holder of a Lease as JSON.
+	lockHolderAnnotation = "forge/holder"
+)
+
+// ConfigMapLocker is a lock.Locker that stores the lock in a Kubernetes
+// ConfigMap, so it guards deploys from every machine that can reach the
+// cluster. Creating a ConfigMap is atomic, so two deploys can't both get it.
+type ConfigMapLocker struct {
+	*k8ClientProvider
+}
+
+// NewLocker builds a ConfigMapLocker that connects to the cluster with the
+// same options as the k8 shippers.
+func NewLocker(opts map[string]interface{}) *ConfigMapLocker {
+	return &ConfigMapLocker{
+		k8ClientProvider: &k8ClientProvider{
+			Opts: opts,
+		},
+	}
+}
+
+func (cml *ConfigMapLocker) Lock(env string, holder lock.Holder) error {
+	client, err := cml.getK8Client()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   lockNamePrefix + env,
+			Labels: map[string]string{"app": "forge"},
+		},
+		Data: map[string]string{lockHolderKey: string(body)},
+	}
+
+	_, err = client.CoreV1().
+		ConfigMaps(cml.namespace()).
+		Create(context.Background(), configMap, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return cml.heldErr(env)
+	}
+	return err
+}
+
+func (cml *ConfigMapLocker) Unlock(env string) error {
+	client, err := cml.getK8Client()
+	if err != nil {
+		return err
+	}
+
+	err = client.CoreV1().
+		ConfigMaps(cml.namespace()).
+		Delete(context.Background(), lockNamePrefix+env, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// heldErr reads the current holder of the lock for env into a HeldErr.
+func (cml *ConfigMapLocker) heldErr(env string) error {
+	client, err := cml.getK8Client()
+	if err != nil {
+		return err
+	}
+
+	configMap, err := client.CoreV1().
+		ConfigMaps(cml.namespace()).
+		Get(context.Background(), lockNamePrefix+env, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	held := lock.HeldErr{Env: env}
+	if err := json.Unmarshal([]byte(configMap.Data[lockHolderKey]), &held.Holder); err != nil {
+		return err
+	}
+	return held
+}
+
+// LeaseLocker is a lock.Locker that stores the lock in a coordination.k8s.io
+// Lease, the object Kubernetes itself uses for locks. The Lease's holder
+// identity shows who holds it to anyone looking at the cluster. It never
+// expires, so it is released the same way as a ConfigMapLocker's lock.
+type LeaseLocker struct {
+	*k8ClientProvider
+}
+
+// NewLeaseLocker builds a LeaseLocker that connects to the cluster with the
+// same options as the k8 shippers.
+func NewLeaseLocker(opts map[string]interface{}) *LeaseLocker {
+	return &LeaseLocker{
+		k8ClientProvider: &k8ClientProvider{
+			Opts: opts,
+		},
+	}
+}
+
+func (ll *LeaseLocker) Lock(env string, holder lock.Holder) error {
+	client, err := ll.getK8Client()
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+
+	identity := fmt.Sprintf("%v@%v", holder.User, holder.Host)
+	acquired := metav1.NewMicroTime(holder.Acquired)
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        lockNamePrefix + env,
+			Labels:      map[string]string{"app": "forge"},
+			Annotations: map[string]string{lockHolderAnnotation: string(body)},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity: &identity,
+			AcquireTime:    &acquired,
+		},
+	}
+
+	_, err = client.CoordinationV1().
+		Leases(ll.namespace()).
+		Create(context.Background(), lease, metav1.CreateOptions{})
+	if errors.IsAlreadyExists(err) {
+		return ll.heldErr(env)
+	}
+	return err
+}
+
+func (ll *LeaseLocker) Unlock(env string) error {
+	client, err := ll.getK8Client()
+	if err != nil {
+		return err
+	}
+
+	err = client.CoordinationV1().
+		Leases(ll.namespace()).
+		Delete(context.Background(), lockNamePrefix+env, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// heldErr reads the current holder of the lock for env into a HeldErr.
+func (ll *LeaseLocker) heldErr(env string) error {
+	client, err := ll.getK8Client()
+	if err != nil {
+		return err
+	}
+
+	lease, err := client.CoordinationV1().
+		Leases(ll.namespace()).
+		Get(context.Background(), lockNamePrefix+env, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	held := lock.HeldErr{Env: env}
+	if err := json.Unmarshal([]byte(lease.Annotations[lockHolderAnnotation]), &held.Holder); err != nil {
+		return err
+	}
+	return held
+}
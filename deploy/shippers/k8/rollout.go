@@ -0,0 +1,78 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// rolloutCheckInterval is how often waitForRollout checks on a rollout.
+var rolloutCheckInterval = 2 * time.Second
+
+// failedWaitingReasons are the reasons a container waits for that it won't
+// get out of without a change to the pod.
+var failedWaitingReasons = [...]string{
+	"CrashLoopBackOff",
+	"CreateContainerConfigError",
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"InvalidImageName",
+}
+
+// waitForRollout calls check until it reports that the rollout is done or
+// returns an error. It returns the context's error if ctx is canceled first.
+func waitForRollout(ctx context.Context, check func() (bool, error)) error {
+	ticker := time.NewTicker(rolloutCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkPodsFailed returns an error if any of the pods in namespace matching
+// selector has a container that is stuck failing.
+func checkPodsFailed(ctx context.Context, client kubernetes.Interface, namespace, selector string) error {
+	pods, err := client.CoreV1().
+		Pods(namespace).
+		List(ctx, metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return err
+	}
+
+	for idx := range pods.Items {
+		if reason, failed := podFailed(&pods.Items[idx]); failed {
+			return fmt.Errorf("The pod %q failed to start: %v", pods.Items[idx].Name, reason)
+		}
+	}
+	return nil
+}
+
+// podFailed reports whether one of the pod's containers is stuck failing, and
+// why.
+func podFailed(pod *v1.Pod) (string, bool) {
+	for _, stat := range pod.Status.ContainerStatuses {
+		if stat.State.Waiting == nil {
+			continue
+		}
+		for _, reason := range failedWaitingReasons {
+			if stat.State.Waiting.Reason == reason {
+				return reason, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,280 @@
+package k8
+
+import (
+	"context"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// statefulSet updates a StatefulSet and waits for its pods to be replaced in
+// the order the controller replaces them, from the highest ordinal down.
+type statefulSet struct {
+	// The name of the StatefulSet once it has been updated, and the pod
+	// template it had before, so that it can be rolled back.
+	updated  string
+	previous *v1.PodTemplateSpec
+}
+
+func (ss *statefulSet) update(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) error {
+	set, err := ss.getCurrentStatefulSet(ctx, client, obj)
+	if err != nil {
+		return err
+	}
+
+	// Last chance to stop before anything changes.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	previous := set.Spec.Template.DeepCopy()
+	ss.updateObject(set, image, tag)
+
+	updated, err := client.AppsV1().
+		StatefulSets(set.Namespace).
+		Update(ctx, set, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+	ss.updated = set.Name
+	ss.previous = previous
+
+	if set.Spec.UpdateStrategy.Type == appsv1.OnDeleteStatefulSetStrategyType {
+		engine.Warn(ctx, "StatefulSet %v uses the OnDelete strategy, its pods only run %v once they are deleted", set.Name, tag)
+		return nil
+	}
+	return ss.waitForPods(ctx, client, updated, obj.pods(tag))
+}
+
+// waitForPods waits for every pod from the highest ordinal down to the
+// partition to run the StatefulSet's update revision and be ready. It fails
+// as soon as one of the new pods matching selector is stuck failing.
+func (ss *statefulSet) waitForPods(
+	ctx context.Context,
+	client kubernetes.Interface,
+	set *appsv1.StatefulSet,
+	selector string,
+) error {
+	var partition int32
+	if rolling := set.Spec.UpdateStrategy.RollingUpdate; rolling != nil && rolling.Partition != nil {
+		partition = *rolling.Partition
+	}
+	next := statefulSetReplicas(set) - 1
+
+	return waitForRollout(ctx, func() (bool, error) {
+		current, err := client.AppsV1().
+			StatefulSets(set.Namespace).
+			Get(ctx, set.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		} else if current.Status.ObservedGeneration < current.Generation {
+			return false, nil
+		}
+
+		if err := checkPodsFailed(ctx, client, set.Namespace, selector); err != nil {
+			return false, err
+		}
+
+		for ; next >= partition; next-- {
+			pod, err := client.CoreV1().
+				Pods(set.Namespace).
+				Get(ctx, fmt.Sprintf("%v-%d", set.Name, next), metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				return false, nil
+			} else if err != nil {
+				return false, err
+			}
+
+			if pod.Labels[appsv1.StatefulSetRevisionLabel] != current.Status.UpdateRevision || !isPodReady(pod) {
+				return false, nil
+			}
+			engine.Progress(ctx, "Pod %v is ready", pod.Name)
+		}
+		return true, nil
+	})
+}
+
+func (ss *statefulSet) plan(ctx context.Context, client kubernetes.Interface, obj object, image, tag string) (string, error) {
+	set, err := ss.getCurrentStatefulSet(ctx, client, obj)
+	if err != nil {
+		return "", err
+	}
+
+	return describeImageChanges(
+		"StatefulSet",
+		set.Name,
+		set.Labels,
+		image,
+		tag,
+		set.Spec.Template.Spec.Containers,
+	), nil
+}
+
+// rollback restores the pod template the StatefulSet had before it was
+// updated. A rolling update with the OrderedReady policy never replaces a pod
+// that is stuck failing, so while the update is still in progress, the pods
+// already running the failed revision are deleted for the controller to
+// recreate them from the restored template.
+func (ss *statefulSet) rollback(ctx context.Context, client kubernetes.Interface, obj object) error {
+	if ss.updated == "" {
+		return nil
+	}
+
+	sets := client.AppsV1().StatefulSets(obj.namespace)
+	set, err := sets.Get(ctx, ss.updated, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	var failed string
+	if set.Status.UpdateRevision != set.Status.CurrentRevision {
+		failed = set.Status.UpdateRevision
+	}
+
+	set.Spec.Template = *ss.previous
+	if version, ok := ss.previous.Labels["version"]; ok {
+		set.Labels["version"] = version
+	}
+	updated, err := sets.Update(ctx, set, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if failed != "" {
+		if err := ss.deleteRevisionPods(ctx, client, updated, failed); err != nil {
+			return err
+		}
+	}
+
+	ss.updated = ""
+	return nil
+}
+
+// deleteRevisionPods deletes the StatefulSet's pods that run revision.
+func (ss *statefulSet) deleteRevisionPods(
+	ctx context.Context,
+	client kubernetes.Interface,
+	set *appsv1.StatefulSet,
+	revision string,
+) error {
+	selector, err := metav1.LabelSelectorAsSelector(set.Spec.Selector)
+	if err != nil {
+		return err
+	}
+
+	pods := client.CoreV1().Pods(set.Namespace)
+	list, err := pods.List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+
+	for idx := range list.Items {
+		pod := &list.Items[idx]
+		if !metav1.IsControlledBy(pod, set) || pod.Labels[appsv1.StatefulSetRevisionLabel] != revision {
+			continue
+		}
+
+		engine.Progress(ctx, "Deleting pod %v, it runs the failed revision %v", pod.Name, revision)
+		err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deployed reports the StatefulSet as healthy once every replica runs the
+// update revision and is ready.
+func (ss *statefulSet) deployed(ctx context.Context, client kubernetes.Interface, obj object) (string, bool, error) {
+	set, err := ss.getCurrentStatefulSet(ctx, client, obj)
+	if err != nil {
+		return "", false, err
+	}
+
+	return set.Labels["version"], isStatefulSetHealthy(set), nil
+}
+
+func (ss *statefulSet) status(ctx context.Context, client kubernetes.Interface, obj object, image string) (engine.Status, error) {
+	set, err := ss.getCurrentStatefulSet(ctx, client, obj)
+	if err != nil {
+		return engine.Status{}, err
+	}
+
+	return engine.Status{
+		Version: set.Labels["version"],
+		Image:   containerImage(image, set.Spec.Template.Spec.Containers),
+		Replicas: &engine.Replicas{
+			Ready:   int(set.Status.ReadyReplicas),
+			Desired: int(statefulSetReplicas(set)),
+		},
+	}, nil
+}
+
+// getCurrentStatefulSet retrieves the StatefulSet in obj's namespace that
+// matches its selector.
+func (ss *statefulSet) getCurrentStatefulSet(
+	ctx context.Context,
+	client kubernetes.Interface,
+	obj object,
+) (
+	*appsv1.StatefulSet,
+	error,
+) {
+	sets, err := client.AppsV1().
+		StatefulSets(obj.namespace).
+		List(ctx, metav1.ListOptions{
+			LabelSelector: obj.selector,
+		})
+
+	if err != nil {
+		return nil, err
+	} else if len(sets.Items) > 1 {
+		return nil, ErrNonUniqueName
+	} else if len(sets.Items) < 1 {
+		return nil, ErrUnmatchedName
+	}
+
+	return &sets.Items[0], nil
+}
+
+// updateObject updates the StatefulSet's container.image and version labels
+// to the new `tag`.
+func (ss *statefulSet) updateObject(set *appsv1.StatefulSet, image, tag string) {
+	containers := updateContainerImages(
+		image,
+		tag,
+		set.Spec.Template.Spec.Containers,
+	)
+
+	if set.Spec.Template.Labels == nil {
+		set.Spec.Template.Labels = make(map[string]string)
+	}
+
+	set.Labels["version"] = tag
+	set.Spec.Template.Labels["version"] = tag
+	set.Spec.Template.Spec.Containers = containers
+}
+
+// statefulSetReplicas returns the number of replicas the StatefulSet asks
+// for, which Kubernetes defaults to 1.
+func statefulSetReplicas(set *appsv1.StatefulSet) int32 {
+	if set.Spec.Replicas != nil {
+		return *set.Spec.Replicas
+	}
+	return 1
+}
+
+func isStatefulSetHealthy(set *appsv1.StatefulSet) bool {
+	replicas := statefulSetReplicas(set)
+	status := set.Status
+	return status.ObservedGeneration >= set.Generation &&
+		status.UpdateRevision == status.CurrentRevision &&
+		status.UpdatedReplicas == replicas &&
+		status.ReadyReplicas == replicas
+}
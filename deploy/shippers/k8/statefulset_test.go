@@ -0,0 +1,89 @@
+package k8
+
+import (
+	"context"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testStatefulSet is a StatefulSet of testObject whose update from revision
+// web-1 to web-2 is in progress at the given revision.
+func testStatefulSet(updateRevision string) *appsv1.StatefulSet {
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "web",
+			Namespace: "default",
+			UID:       "web-uid",
+			Labels:    map[string]string{"app": "web", "version": "v2"},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web", "version": "v2"}},
+			},
+		},
+		Status: appsv1.StatefulSetStatus{CurrentRevision: "web-1", UpdateRevision: updateRevision},
+	}
+}
+
+// statefulSetPod is a pod of set at revision.
+func statefulSetPod(set *appsv1.StatefulSet, name, revision string) *v1.Pod {
+	pod := testPod(name, map[string]string{"app": "web", appsv1.StatefulSetRevisionLabel: revision}, false, 5)
+	pod.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(set, appsv1.SchemeGroupVersion.WithKind("StatefulSet"))}
+	return pod
+}
+
+func TestStatefulSetRollbackDeletesTheFailedRevisionsPods(t *testing.T) {
+	tests := []struct {
+		name           string
+		updateRevision string
+		deleted        []string
+	}{
+		{"update in progress", "web-2", []string{"web-2"}},
+		{"update finished", "web-1", nil},
+	}
+
+	for _, test := range tests {
+		set := testStatefulSet(test.updateRevision)
+		objects := []runtime.Object{
+			set,
+			statefulSetPod(set, "web-0", "web-1"),
+			statefulSetPod(set, "web-1", "web-1"),
+			statefulSetPod(set, "web-2", test.updateRevision),
+		}
+		client := fake.NewSimpleClientset(objects...)
+
+		previous := set.Spec.Template.DeepCopy()
+		previous.Labels["version"] = "v1"
+		ss := &statefulSet{updated: "web", previous: previous}
+		if err := ss.rollback(context.Background(), client, testObject); err != nil {
+			t.Fatalf("%v: the rollback failed: %v", test.name, err)
+		}
+
+		restored, err := client.AppsV1().StatefulSets("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		} else if v := restored.Spec.Template.Labels["version"]; v != "v1" {
+			t.Errorf("%v: the pod template runs %v, expected it restored to v1", test.name, v)
+		}
+
+		var deleted []string
+		for _, name := range []string{"web-0", "web-1", "web-2"} {
+			_, err := client.CoreV1().Pods("default").Get(context.Background(), name, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				deleted = append(deleted, name)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(deleted) != len(test.deleted) || (len(deleted) > 0 && deleted[0] != test.deleted[0]) {
+			t.Errorf("%v: deleted pods %v, expected %v", test.name, deleted, test.deleted)
+		}
+	}
+}
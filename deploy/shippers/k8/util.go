@@ -1,8 +1,11 @@
 package k8
 
 import (
+	"bytes"
+	"fmt"
 	"k8s.io/api/core/v1"
 	"strings"
+	"time"
 )
 
 // updateContainerImages iterates the list of containers and updates the
@@ -21,3 +24,85 @@ func updateContainerImages(image, tag string, containers []v1.Container) []v1.Co
 
 	return newContainers
 }
+
+// containerImage returns the image:tag of the first container that uses
+// image.
+func containerImage(image string, containers []v1.Container) string {
+	for _, c := range containers {
+		if strings.Split(c.Image, ":")[0] == image {
+			return c.Image
+		}
+	}
+	return ""
+}
+
+// describeImageChanges summarizes the changes that updateContainerImages and
+// the "version" label update would make to a Kubernetes object.
+func describeImageChanges(
+	kind string,
+	objName string,
+	labels map[string]string,
+	image string,
+	tag string,
+	containers []v1.Container,
+) string {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "%v %q: version label %q -> %q\n", kind, objName, labels["version"], tag)
+
+	newContainers := updateContainerImages(image, tag, containers)
+	matched := false
+	for idx, c := range containers {
+		if strings.Split(c.Image, ":")[0] != image {
+			continue
+		}
+		matched = true
+		fmt.Fprintf(buffer, "  container %q: %v -> %v\n", c.Name, c.Image, newContainers[idx].Image)
+	}
+
+	if !matched {
+		fmt.Fprintf(buffer, "  no containers use the image %v\n", image)
+	}
+	return buffer.String()
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
+}
+
+// intOpt reads a whole number option, returning def when it isn't set.
+func intOpt(opts map[string]interface{}, key string, def int32) (int32, error) {
+	value, ok := opts[key]
+	if !ok {
+		return def, nil
+	}
+
+	number, ok := value.(int)
+	if !ok {
+		return 0, fmt.Errorf("Invalid %v %v, expected a whole number", key, value)
+	}
+	return int32(number), nil
+}
+
+// durationOpt reads a duration option such as "90s", returning def when it
+// isn't set.
+func durationOpt(opts map[string]interface{}, key string, def time.Duration) (time.Duration, error) {
+	value, ok := opts[key]
+	if !ok {
+		return def, nil
+	}
+
+	text, ok := value.(string)
+	if !ok {
+		return 0, fmt.Errorf("Invalid %v %v, expected a duration such as \"90s\"", key, value)
+	}
+
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %v %q, expected a duration such as \"90s\"", key, text)
+	}
+	return duration, nil
+}
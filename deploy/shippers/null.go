@@ -16,3 +16,7 @@ func (ns NullShipper) Rollback(ctx context.Context) chan error {
 	close(ch)
 	return ch
 }
+
+func (ns NullShipper) Plan(ctx context.Context) (string, error) {
+	return "Nothing to do.", nil
+}
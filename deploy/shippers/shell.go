@@ -1,6 +1,7 @@
 package shippers
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -23,11 +24,16 @@ func (shsh *ShellShipper) ShipIt(ctx context.Context) chan error {
 		defer close(ch)
 		defer failSafe("ShellShipper", ch)
 
+		// There's no telling what the steps do, so assume they all change
+		// something.
+		engine.Mutating(ctx)
+
 		for _, s := range steps {
 			// Check in between steps to see if the context has been canceled. If
 			// it has, stop processing work.
 			select {
 			case <-ctx.Done():
+				ch <- ctx.Err()
 				return
 			default: // Don't block.
 			}
@@ -38,8 +44,9 @@ func (shsh *ShellShipper) ShipIt(ctx context.Context) chan error {
 				return
 			}
 
-			bash := exec.Command("bash", "-c", step, "--", opts.Version)
-			bash.Stdout = os.Stdout
+			engine.Progress(ctx, "Running step: %v", step)
+			bash := exec.CommandContext(ctx, "bash", "-c", step, "--", opts.Version)
+			bash.Stdout = engine.Output(ctx)
 			bash.Stderr = os.Stderr
 
 			if err := bash.Run(); err != nil {
@@ -51,6 +58,25 @@ func (shsh *ShellShipper) ShipIt(ctx context.Context) chan error {
 	return ch
 }
 
+// Plan lists the steps that ShipIt would run, in order.
+func (shsh *ShellShipper) Plan(ctx context.Context) (string, error) {
+	steps, _ := shsh.Opts["steps"].([]interface{})
+	opts := engine.OptionsFromContext(ctx)
+
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "Would run %d step(s) with $1=%q:\n", len(steps), opts.Version)
+	for idx, s := range steps {
+		fmt.Fprintf(buffer, "  %d. bash -c %q\n", idx+1, fmt.Sprint(s))
+	}
+	return buffer.String(), nil
+}
+
+// Status can't know what the steps deployed, so the version is always
+// unknown.
+func (shsh *ShellShipper) Status(ctx context.Context) (engine.Status, error) {
+	return engine.Status{Version: engine.StatusUnknown}, nil
+}
+
 func (shsh *ShellShipper) Rollback(ctx context.Context) chan error {
 	ch := make(chan error)
 	close(ch)
@@ -0,0 +1,141 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/ki4jnq/forge"
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+var (
+	statusCmd   *forge.Cmd
+	statusFlags = flag.NewFlagSet("status", flag.ExitOnError)
+
+	statusOutput string
+)
+
+// targetStatus is a row of `forge status`.
+type targetStatus struct {
+	Target  string `json:"target"`
+	Shipper string `json:"shipper"`
+	engine.Status
+	Error string `json:"error,omitempty"`
+}
+
+// registerStatus registers the `forge status` command. It lives with deploy
+// because it reads the deploy section of the Forgefile.
+func registerStatus() {
+	statusFlags.StringVar(
+		&statusOutput,
+		"output",
+		"text",
+		"The format of the status, either \"text\" or \"json\".",
+	)
+
+	statusCmd = &forge.Cmd{
+		Name:      "status",
+		Flags:     statusFlags,
+		SubRunner: runStatus,
+	}
+	forge.Register(statusCmd)
+}
+
+// runStatus asks every target in the environment what is deployed and prints
+// the answers.
+func runStatus() error {
+	if statusOutput != "text" && statusOutput != "json" {
+		return fmt.Errorf("Unknown output format %q, expected \"text\" or \"json\"", statusOutput)
+	}
+
+	env := statusCmd.Conf.Env
+	names := make([]string, 0, len(conf.Targets))
+	for name := range conf.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	ctx := engine.ContextForOptions(engine.Options{Env: env, Vars: statusCmd.Vars})
+	statuses := make([]targetStatus, len(names))
+	failed := 0
+	for i, name := range names {
+		block := conf.Targets[name]
+		statuses[i] = targetStatus{Target: name, Shipper: block.ShipperName}
+
+		target, err := block.toTarget()
+		if err == nil {
+			statuses[i].Status, err = inspect(ctx, target.Shipper)
+		}
+		if err != nil {
+			statuses[i].Error = err.Error()
+			failed++
+		}
+	}
+
+	if statusOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(statuses); err != nil {
+			return err
+		}
+	} else {
+		printStatuses(statuses)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d target(s) couldn't report their status", failed)
+	}
+	return nil
+}
+
+// inspect returns the shipper's Status, or an unknown one if the shipper
+// isn't an Inspector.
+func inspect(ctx context.Context, shipper engine.Shipper) (engine.Status, error) {
+	inspector, ok := shipper.(engine.Inspector)
+	if !ok {
+		return engine.Status{Version: engine.StatusUnknown}, nil
+	}
+	return inspector.Status(ctx)
+}
+
+func printStatuses(statuses []targetStatus) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET\tSHIPPER\tVERSION\tIMAGE\tREPLICAS\tDETAILS")
+
+	for _, s := range statuses {
+		replicas := "-"
+		if s.Replicas != nil {
+			replicas = s.Replicas.String()
+		}
+
+		details := s.Details
+		if s.Error != "" {
+			details = "ERROR: " + s.Error
+		}
+
+		fmt.Fprintf(
+			table,
+			"%v\t%v\t%v\t%v\t%v\t%v\n",
+			s.Target,
+			s.Shipper,
+			orDash(s.Version),
+			orDash(s.Image),
+			replicas,
+			details,
+		)
+	}
+
+	table.Flush()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,126 @@
+package deploy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+
+	"github.com/ki4jnq/forge/deploy/engine"
+)
+
+// The strategies for finding the version to deploy when --version isn't
+// passed.
+const (
+	versionFromFile        = "file"
+	versionFromGitDescribe = "git-describe"
+	versionFromGitSHA      = "git-sha"
+	versionFromFlag        = "flag"
+)
+
+// defaultVersionFile is read by the "file" strategy when the Forgefile
+// doesn't name a file.
+const defaultVersionFile = "VERSION"
+
+var (
+	ErrDirtyTree = errors.New(
+		"The working tree has uncommitted changes, commit them or pass --allow-dirty to deploy anyway",
+	)
+)
+
+// versionBlock configures where the version comes from when --version isn't
+// passed.
+type versionBlock struct {
+	From string
+	File string
+}
+
+// resolve returns the version to deploy: flagVersion when it is set, and the
+// result of the configured strategy otherwise.
+func (vb versionBlock) resolve(flagVersion string) (string, error) {
+	if flagVersion != "" {
+		return flagVersion, nil
+	}
+
+	var version string
+	var err error
+	switch vb.From {
+	case "", versionFromFile:
+		version, err = readVersionFile(vb.File)
+	case versionFromGitDescribe:
+		version, err = git("describe", "--tags")
+	case versionFromGitSHA:
+		version, err = git("rev-parse", "--short=12", "HEAD")
+	case versionFromFlag:
+		return "", engine.ErrNoVersion
+	default:
+		return "", fmt.Errorf(
+			"Unknown version strategy %q, expected one of \"%v\", \"%v\", \"%v\" or \"%v\"",
+			vb.From,
+			versionFromFile,
+			versionFromGitDescribe,
+			versionFromGitSHA,
+			versionFromFlag,
+		)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("Finding the version to deploy: %v", err)
+	} else if version == "" {
+		return "", engine.ErrNoVersion
+	}
+	return version, nil
+}
+
+// needsVersion reports whether any of the targets can't ship without a
+// version.
+func needsVersion(targets engine.Targets) bool {
+	for _, target := range targets {
+		if versioned, ok := target.Shipper.(engine.VersionedShipper); ok && versioned.NeedsVersion() {
+			return true
+		}
+	}
+	return false
+}
+
+func readVersionFile(path string) (string, error) {
+	if path == "" {
+		path = defaultVersionFile
+	}
+
+	buffer, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buffer)), nil
+}
+
+// checkClean returns ErrDirtyTree if tracked files in the working tree have
+// uncommitted changes. Untracked files, like the deploy history, are ignored,
+// and so is a project that isn't in a git repository.
+func checkClean() error {
+	if _, err := git("rev-parse", "--is-inside-work-tree"); err != nil {
+		return nil
+	}
+
+	changes, err := git("status", "--porcelain", "--untracked-files=no")
+	if err != nil {
+		return err
+	} else if changes != "" {
+		return ErrDirtyTree
+	}
+	return nil
+}
+
+// git runs a git command and returns its trimmed output. Failures include
+// whatever git printed to stderr.
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("git %v: %v", args[0], strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -1,16 +1,36 @@
 package forge
 
 func NewParser(env string) *Unformatter {
-	envUnformatter := EnvUnformatter{
-		Version: SectionUnformatter{"version"},
-		Db:      SectionUnformatter{"db"},
-		Run:     SectionUnformatter{"run"},
-		Deploy:  SectionUnformatter{"deploy"},
+	return newEnvParser(env, EnvUnformatter{
+		Version: SectionUnformatter{cmdName: "version"},
+		Db:      SectionUnformatter{cmdName: "db"},
+		Run:     SectionUnformatter{cmdName: "run"},
+		Deploy:  SectionUnformatter{cmdName: "deploy"},
+	})
+}
+
+// newSectionParser reads only section, for env, into conf.
+func newSectionParser(env, section string, conf interface{}) *Unformatter {
+	envUnformatter := EnvUnformatter{}
+	target := SectionUnformatter{cmdName: section, conf: conf}
+	switch section {
+	case "version":
+		envUnformatter.Version = target
+	case "db":
+		envUnformatter.Db = target
+	case "run":
+		envUnformatter.Run = target
+	case "deploy":
+		envUnformatter.Deploy = target
 	}
+	return newEnvParser(env, envUnformatter)
+}
 
+// newEnvParser reads the "all" environment and env with envUnformatter.
+func newEnvParser(env string, envUnformatter EnvUnformatter) *Unformatter {
 	unformatter := &Unformatter{All: envUnformatter}
 
-	switch env {
+	switch envKey(env) {
 	case "qa":
 		unformatter.Qa = envUnformatter
 	case "staging":
@@ -22,14 +42,22 @@ func NewParser(env string) *Unformatter {
 	case "uat":
 		unformatter.Uat = envUnformatter
 	case "development":
-		fallthrough
-	default:
-		// Default to development.
 		unformatter.Development = envUnformatter
 	}
 	return unformatter
 }
 
+// envKey returns the top-level Forgefile key that holds env's configuration.
+func envKey(env string) string {
+	switch env {
+	case "qa", "staging", "production", "test", "uat":
+		return env
+	default:
+		// Default to development.
+		return "development"
+	}
+}
+
 // All possible top-level objects in the Forgefile.
 type Unformatter struct {
 	All         EnvUnformatter
@@ -50,12 +78,18 @@ type EnvUnformatter struct {
 }
 
 // SectionUnformatter will read the configurations for any given subcommand
-// into the registered command's SubConfig object.
+// into the registered command's SubConfig object, or into conf when it is
+// set.
 type SectionUnformatter struct {
 	cmdName string
+	conf    interface{}
 }
 
 func (sf *SectionUnformatter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if sf.conf != nil {
+		return unmarshal(sf.conf)
+	}
+
 	cmd, ok := Registry[sf.cmdName]
 	if !ok {
 		return nil
@@ -0,0 +1,57 @@
+package forge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Vars are the variables available to the Forgefile through the `var`
+// template function, and to the commands that run with it. Vars implements
+// flag.Value, so that --var key=value can be repeated.
+type Vars map[string]string
+
+func (v Vars) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v Vars) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("Invalid variable %q, expected key=value", pair)
+	}
+	v[parts[0]] = parts[1]
+	return nil
+}
+
+// merge returns a copy of v with every variable from others added to it, in
+// order, so later ones win.
+func (v Vars) merge(others ...Vars) Vars {
+	merged := make(Vars, len(v))
+	for key, value := range v {
+		merged[key] = value
+	}
+	for _, other := range others {
+		for key, value := range other {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// varsUnformatter reads the vars block of every environment in the
+// Forgefile, and ignores everything else.
+type varsUnformatter map[string]struct {
+	Vars Vars
+}
+
+// envVars merges the vars blocks that apply to env, with env's own block
+// taking precedence over the "all" block.
+func (vu varsUnformatter) envVars(env string) Vars {
+	return vu["all"].Vars.merge(vu[envKey(env)].Vars)
+}